@@ -0,0 +1,41 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// access is a variable so tests can simulate permission problems
+var access = func(path string, mode uint32) error {
+	return syscall.Access(path, mode)
+}
+
+func ownedByUser(info fs.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Geteuid()
+}
+
+// fileOwner returns the uid of the owner of info
+func fileOwner(info fs.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
+
+// dirPerm is the mode of new cache folders; a cache created by root
+// is not writable by others regardless of umask
+func dirPerm() fs.FileMode {
+	if os.Geteuid() == 0 {
+		return 0755
+	}
+	return 0777
+}
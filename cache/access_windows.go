@@ -0,0 +1,27 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"io/fs"
+)
+
+// no access check on windows
+var access = func(path string, mode uint32) error {
+	return nil
+}
+
+func ownedByUser(info fs.FileInfo) bool {
+	return false
+}
+
+// no owner on windows => no ownership checks
+func fileOwner(info fs.FileInfo) (int, bool) {
+	return 0, false
+}
+
+func dirPerm() fs.FileMode {
+	return 0777
+}
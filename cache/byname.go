@@ -0,0 +1,84 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// byNameDir holds a symlink per name to the objdir of the last Link,
+// e.g. by-name/tool.go -> ../data/NN-t/<hash40>/<hash8>, so that a
+// human can find the cache entry of a script
+func (config *Config) byNameDir() string {
+	return filepath.Join(config.dir, "by-name")
+}
+
+// sanitizeName keeps letters, digits, '.', '-' and '_' of name, other
+// characters become '_'; "" if nothing useful remains
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	if strings.Trim(name, ".") == "" {
+		return ""
+	}
+	return name
+}
+
+// Link points the by-name link of name, e.g. the base name of a script,
+// to objdir from Lookup. The link is replaced atomically, so the last
+// Link of a name wins, and TrimNow removes it when objdir is gone.
+// The link is informational and not used by the cache.
+func (config *Config) Link(name string, objdir string) error {
+	name = sanitizeName(name)
+	if name == "" {
+		return fmt.Errorf("no usable characters in name")
+	}
+	target, err := filepath.Rel(config.byNameDir(), objdir)
+	if err != nil || !strings.HasPrefix(filepath.ToSlash(target), "../data/") {
+		return fmt.Errorf("%s is not an objdir of the cache", objdir)
+	}
+	err = config.storage.MkdirAll(config.byNameDir())
+	if err != nil {
+		return err
+	}
+	return config.storage.Symlink(target, filepath.Join(config.byNameDir(), name))
+}
+
+// trimLinks removes the by-name links to deleted objdirs
+func (config *Config) trimLinks() error {
+	entries, err := config.storage.ReadDir(config.byNameDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		link := filepath.Join(config.byNameDir(), entry.Name())
+		if entry.Type()&fs.ModeSymlink == 0 {
+			continue
+		}
+		exists, err := config.storage.Exists(link)
+		if err == nil && !exists {
+			err = config.storage.Remove(link)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
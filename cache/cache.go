@@ -6,18 +6,23 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/bir3/gocompiler/extra"
+	"github.com/bir3/gocompiler/extra/filelock"
 )
 
 func jsonString(m map[string]string) (string, error) {
@@ -40,31 +45,122 @@ type Stat struct {
 	Dir       string
 }
 
+// GetInfo sums the parts in parallel, which helps on slow disks
 func (config *Config) GetInfo() (Stat, error) {
 	info := Stat{}
+	var mu sync.Mutex
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				partInfo := Stat{}
+				config.GetPartInfo(&partInfo, part)
+				mu.Lock()
+				info.Count += partInfo.Count
+				info.SizeBytes += partInfo.SizeBytes
+				mu.Unlock()
+			}
+		}()
+	}
 	for part := 0; part < 256; part++ {
-		config.GetPartInfo(&info, part)
+		parts <- part
 	}
+	close(parts)
+	wg.Wait()
 	info.Dir = config.dir
 	return info, nil
 }
 
 func (config *Config) GetPartInfo(stat *Stat, part int) {
-	dir := config.partPrefix(part)
-
-	e := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err == nil && !d.IsDir() {
-			info, err := d.Info()
-			if err == nil {
-				stat.SizeBytes += info.Size()
-				stat.Count += 1
+	count, size := config.storage.Usage(config.partPrefix(part))
+	stat.Count += count
+	stat.SizeBytes += size
+}
+
+// Entry describes a cached item
+type Entry struct {
+	Objdir    string
+	LastUsed  time.Time     // refreshed at most every refresh age, see Options.RefreshAge
+	Age       time.Duration // since LastUsed when read
+	Refreshes int64         // lookups that refreshed LastUsed, at most one per refresh age
+	SizeBytes int64
+}
+
+// List returns the items of the cache without locks, so items may change
+// or be deleted while it runs; use Walk for locked reads.
+func (config *Config) List() ([]Entry, error) {
+	var entries []Entry
+	for part := 0; part < 256; part++ {
+		flist, err := config.storage.ListItems(config.partPrefix(part))
+		if err != nil {
+			continue // e.g. part folder deleted by user
+		}
+		for _, lockfile := range flist {
+			if entry, ok := config.entry(lockfile); ok {
+				entries = append(entries, entry)
 			}
 		}
-		return nil
-	})
-	if e != nil {
-		return
 	}
+	return entries, nil
+}
+
+// Walk calls fn for each item of the cache. The items of a part are read
+// under a shared part lock, so an item is never seen half written, but
+// fn is called after the lock is released: fn may e.g. Purge an item.
+// Items being created and items with an unparseable info are skipped.
+// An error from fn stops the walk and is returned.
+func (config *Config) Walk(fn func(entry Entry) error) error {
+	for part := 0; part < 256; part++ {
+		var entries []Entry
+		withPartLock := func() error {
+			flist, err := config.storage.ListItems(config.partPrefix(part))
+			if err != nil {
+				return nil // e.g. part folder deleted by user
+			}
+			for _, lockfile := range flist {
+				if entry, ok := config.entry(lockfile); ok {
+					entries = append(entries, entry)
+				}
+			}
+			return nil
+		}
+		hash := fmt.Sprintf("%02x", part)
+		err := config.locker.lockedfile(config.partLock(hash).lockfile, SHARED_LOCK, withPartLock)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err := fn(entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entry reads the item of lockfile, false if being created or deleted
+// or the info can not be parsed
+func (config *Config) entry(lockfile string) (Entry, bool) {
+	buf, err := config.storage.ReadInfo(lockfile2datafile(lockfile))
+	if err != nil {
+		return Entry{}, false
+	}
+	obj, err := str2item(buf)
+	if err != nil {
+		return Entry{}, false
+	}
+	_, size := config.storage.Usage(filepath.Dir(lockfile))
+	return Entry{
+		Objdir:    obj.objdir,
+		LastUsed:  time.Unix(obj.refreshTime, int64(obj.refreshTimeNano)),
+		Age:       obj.age(),
+		Refreshes: obj.refreshes,
+		SizeBytes: size,
+	}, true
 }
 
 func lockfile2datafile(lockfile string) string {
@@ -74,7 +170,8 @@ func lockfile2datafile(lockfile string) string {
 type Item struct {
 	objdir          string
 	refreshTime     int64
-	refreshTimeNano int // only to support faster tests
+	refreshTimeNano int   // only to support faster tests
+	refreshes       int64 // lookups that refreshed the item, for EvictLFU
 }
 
 func (obj *Item) refresh() {
@@ -89,41 +186,78 @@ func (obj *Item) age() time.Duration {
 }
 
 func item2str(obj Item) string {
-	return fmt.Sprintf("%s %d %d\n", obj.objdir, obj.refreshTime, obj.refreshTimeNano)
+	s := fmt.Sprintf("%s %d %d\n", obj.objdir, obj.refreshTime, obj.refreshTimeNano)
+	if obj.refreshes > 0 {
+		s += fmt.Sprintf("refreshes %d\n", obj.refreshes)
+	}
+	return s
 }
 
 func str2item(s string) (Item, error) {
-	// format: objdir + " " + unixtime + "\n"
-	// extra content after newline is allowed and ignored
+	// format: objdir + " " + unixtime + " " + nanoseconds + "\n"
+	// optionally followed by "refreshes " + count + "\n"
+	// other content after newline is allowed and ignored, so older
+	// versions of gorun can read the refreshes line
 
 	k := strings.Index(s, "\n")
 	if k < 0 {
-		return Item{"", 0, 0}, fmt.Errorf("parse, missing newline")
+		return Item{}, fmt.Errorf("parse, missing newline")
 	}
-	s = s[0:k]
+	s, rest := s[0:k], s[k+1:]
 	e := strings.Fields(s)
 	if len(e) != 3 {
-		return Item{"", 0, 0}, fmt.Errorf("parse, not three fields: %q", e)
+		return Item{}, fmt.Errorf("parse, not three fields: %q", e)
 	}
 	var err error
 	i, err := strconv.ParseInt(e[1], 10, 64)
 	if err != nil {
-		return Item{"", 0, 0}, fmt.Errorf("parse int failed: %q - %w", e[1], err)
+		return Item{}, fmt.Errorf("parse int failed: %q - %w", e[1], err)
 	}
 	iNano, err := strconv.Atoi(e[2])
 	if err != nil {
-		return Item{"", 0, 0}, fmt.Errorf("parse int failed: %q - %w", e[2], err)
+		return Item{}, fmt.Errorf("parse int failed: %q - %w", e[2], err)
 	}
-	return Item{e[0], i, iNano}, nil
+	var refreshes int64
+	if line, found := strings.CutPrefix(rest, "refreshes "); found {
+		line, _, _ = strings.Cut(line, "\n")
+		// a bad count only loses the count, the item is still valid
+		refreshes, err = strconv.ParseInt(line, 10, 64)
+		if err != nil || refreshes < 0 {
+			refreshes = 0
+		}
+	}
+	return Item{e[0], i, iNano, refreshes}, nil
+
+}
 
+// Hasher computes the cache key of an input.
+// Sum must return lowercase hex of at least 40 characters.
+type Hasher struct {
+	Name string
+	Sum  func(s string) string
 }
 
+// SHA256Hasher is the default hasher
+var SHA256Hasher = Hasher{"sha256", hashString}
+
+// SHA1Hasher is faster on platforms without sha256 instructions.
+// The cache key is not a security boundary within a trusted cache.
+var SHA1Hasher = Hasher{"sha1", func(s string) string {
+	sum := sha1.Sum([]byte(s))
+	// always 40 characters
+	return fmt.Sprintf("%x", sum)
+}}
+
 func hashString(s string) string {
 	sum := sha256.Sum256([]byte(s))
 	// always 64 characters, even with leading zero
 	return fmt.Sprintf("%x", sum)
 }
 
+func (config *Config) hash(input string) string {
+	return config.hasher.Sum(input)
+}
+
 func randomHash() string {
 	// assume minimum go1.20 => no need for rand.Seed(time.Now().UnixNano())
 	uid := fmt.Sprintf("%d", rand.Int63())
@@ -147,15 +281,39 @@ func (config *Config) Lookup(input string, create func(outDir string) error) (st
 	return config.Lookup2(input, create, useCache)
 }
 
+// LookupWait is like Lookup but if another process holds the item, e.g.
+// while creating it, calls waiting once with its pid, zero if unknown,
+// and fails with ErrWaitTimeout if the item is not free within wait
+func (config *Config) LookupWait(input string, create func(outDir string) error, wait time.Duration, waiting func(pid int)) (string, error) {
+	return config.lookup(context.Background(), input, create, wait, waiting)
+}
+
+// LookupWaitContext is like LookupWait but also stops waiting when ctx is
+// done, see LookupContext
+func (config *Config) LookupWaitContext(ctx context.Context, input string, create func(outDir string) error, wait time.Duration, waiting func(pid int)) (string, error) {
+	return config.lookup(ctx, input, create, wait, waiting)
+}
+
+// LookupContext is like Lookup but stops waiting for another process that
+// holds the item when ctx is done. create should use ctx too, e.g. to stop
+// a compile. An item is not recorded if ctx is done when create returns.
+func (config *Config) LookupContext(ctx context.Context, input string, create func(outDir string) error) (string, error) {
+	return config.lookup(ctx, input, create, 0, nil)
+}
+
 func (config *Config) Lookup2(input string, userCreate func(outDir string) error, useCache bool) (string, error) {
 	// NOTE: useCache ignored - if used, must not delete other outdir's that may still be in use
+	return config.lookup(context.Background(), input, userCreate, 0, nil)
+}
 
-	hs := hashString(input)
+func (config *Config) lookup(ctx context.Context, input string, userCreate func(outDir string) error, wait time.Duration, waiting func(pid int)) (string, error) {
+
+	hs := config.hash(input)
 	pair := config.itemLock(hs)
 	lockfile := pair.lockfile
 	datafile := pair.datafile
 
-	err := extra.MkdirAllRace(pair.dir(), 0777)
+	err := config.storage.MkdirAll(pair.dir())
 	if err != nil {
 		return "/invalid/outdir/1", fmt.Errorf("failed to create prefix dir %q - %w", pair.dir(), err)
 	}
@@ -165,16 +323,25 @@ func (config *Config) Lookup2(input string, userCreate func(outDir string) error
 
 		if old == "" {
 			// object not created yet
-			outdir = filepath.Join(pair.dir(), randomHash()[0:8]) // 8 chars = 32 bits
-			err := os.Mkdir(outdir, 0777)
+			config.metrics.misses.Add(1)
+			var err error
+			outdir, err = config.mkdirObjdir(pair.dir())
 			if err != nil {
-				return fmt.Errorf("outdir %q already exists - program error", outdir)
+				return err
 			}
+			// owner in lockfile, not info, for LookupWait and Compiling
+			// of other processes
+			config.writeOwner(lockfile)
 			err = userCreate(outdir)
+			config.storage.WriteFile(lockfile, nil)
+			if err == nil && ctx.Err() != nil {
+				err = fmt.Errorf("create aborted - %w", ctx.Err())
+			}
 			if err != nil {
 				// keep folder so user can debug problem
 				return err
 			}
+			config.metrics.compiles.Add(1)
 			var obj Item
 			obj.objdir = outdir
 			obj.refresh()
@@ -191,12 +358,14 @@ func (config *Config) Lookup2(input string, userCreate func(outDir string) error
 			if err != nil {
 				return fmt.Errorf("cache corruption in file %q - %w", datafile, err)
 			}
+			config.metrics.hits.Add(1)
 
 			outdir = obj.objdir
-			age := obj.age()
-			if age > config.maxAge/10 {
-				obj.refresh()
+			if obj.age() <= config.refreshAge {
+				return nil // recent => no write, the common fast path
 			}
+			obj.refreshes++
+			obj.refresh()
 			err = writeString(item2str(obj))
 			if err != nil {
 				return fmt.Errorf("cache refresh failed for file %q - %w", datafile, err)
@@ -206,25 +375,101 @@ func (config *Config) Lookup2(input string, userCreate func(outDir string) error
 		return nil
 	}
 	withPartLock := func() error {
-		return UpdateMultiprocess(lockfile, EXCLUSIVE_LOCK, datafile, updateContent)
+		itemWaiting := func() {
+			if waiting != nil {
+				waiting(config.readOwner(lockfile).Pid)
+			}
+		}
+		return config.locker.lockedfileWait(ctx, lockfile, EXCLUSIVE_LOCK, wait, itemWaiting, func() error {
+			return config.storage.UpdateInfo(datafile, updateContent)
+		})
 	}
 	withGlobalLock := func() error {
-		return Lockedfile(config.partLock(hs).lockfile, SHARED_LOCK, withPartLock)
+		return config.locker.lockedfile(config.partLock(hs).lockfile, SHARED_LOCK, withPartLock)
 	}
-	err = Lockedfile(config.globalLock().lockfile, SHARED_LOCK, withGlobalLock)
+	err = config.locker.lockedfile(config.globalLock().lockfile, SHARED_LOCK, withGlobalLock)
 	if err != nil {
 		return "/invalid/outdir/2", err
 	}
 	return outdir, nil
 }
 
-func ensureDir(dir string) error {
-	fileinfo, err := os.Stat(dir)
-	if err == nil && fileinfo.IsDir() {
-		return nil
+// Owner is the process that creates an item
+type Owner struct {
+	Pid  int
+	Host string
+}
+
+// writeOwner records the current process in lockfile as "<pid> <host>"
+func (config *Config) writeOwner(lockfile string) {
+	host, _ := os.Hostname()
+	config.storage.WriteFile(lockfile, []byte(fmt.Sprintf("%d %s", os.Getpid(), host)))
+}
+
+// readOwner returns the process recorded in lockfile, zero if none
+func (config *Config) readOwner(lockfile string) Owner {
+	buf, err := config.storage.ReadFile(lockfile)
+	if err != nil {
+		return Owner{}
 	}
+	pid, host, _ := strings.Cut(strings.TrimSpace(string(buf)), " ")
+	n, err := strconv.Atoi(pid)
 	if err != nil {
-		return os.Mkdir(dir, 0777)
+		return Owner{}
 	}
-	return nil
+	return Owner{Pid: n, Host: host}
+}
+
+// Compiling returns the process recorded as creating the item for input
+// and whether it still holds the item. An owner that no longer holds
+// the item did not finish, e.g. it crashed.
+func (config *Config) Compiling(input string) (owner Owner, active bool, err error) {
+	lockfile := config.itemLock(config.hash(input)).lockfile
+	file, err := os.OpenFile(lockfile, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return Owner{}, false, nil
+	}
+	if err != nil {
+		return Owner{}, false, err
+	}
+	defer file.Close()
+	owner = config.readOwner(lockfile)
+	locked, err := tryLock(file)
+	if errors.Is(err, errors.ErrUnsupported) {
+		// no way to test the lock: trust the owner record
+		return owner, owner.Pid != 0, nil
+	}
+	if err != nil {
+		return Owner{}, false, err
+	}
+	if locked {
+		return owner, false, filelock.Unlock(file)
+	}
+	return owner, owner.Pid != 0, nil
+}
+
+// mkdirObjdir creates a new uniq object folder in itemdir
+// - failed creates keep their folder so a random name may collide
+func (config *Config) mkdirObjdir(itemdir string) (string, error) {
+	const retries = 10
+	var err error
+	for i := 0; i < retries; i++ {
+		outdir := filepath.Join(itemdir, config.randFn()[0:8]) // 8 chars = 32 bits
+		err = config.storage.Mkdir(outdir)
+		if err == nil {
+			return outdir, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("failed to create outdir %q - %w", outdir, err)
+		}
+	}
+	return "", fmt.Errorf("failed to create uniq outdir in %q after %d tries - %w", itemdir, retries, err)
+}
+
+func (config *Config) ensureDir(dir string) error {
+	exists, err := config.storage.Exists(dir)
+	if err == nil && !exists {
+		return config.storage.Mkdir(dir)
+	}
+	return err
 }
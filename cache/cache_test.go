@@ -6,17 +6,24 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -57,7 +64,7 @@ OnceMultiprocess.Do(sharedfilename string, f func())
 - add normal cache use, verify performance, e.g. just basic sanity
 - cache2: cleanup multiple objects per skey as there is only one owner
 
-- cache2: later: add special cleanup mode that can size-limit cache and cleanup empty folders and stale .lock files
+- cache2: later: cleanup empty folders
 
 explore: CCT testing
 
@@ -167,7 +174,7 @@ func TestCache(t *testing.T) {
 	cacheDir := tmpdir(t)
 	// debug: rm -rf tmp; GORUN_TESTDIR=$(pwd)/tmp go test ./cache
 
-	config, err := newConfig(cacheDir, time.Millisecond*30)
+	config, err := newConfig(cacheDir, time.Millisecond*30, Options{Grace: -1}) // no grace: items expire after maxAge
 
 	create := func(key string) {
 		_, err := config.Lookup(key, func(objdir string) error {
@@ -201,7 +208,7 @@ func TestRefresh(t *testing.T) {
 	t.Parallel()
 	cacheDir := t.TempDir()
 
-	config, err := newConfig(cacheDir, time.Millisecond*30)
+	config, err := newConfig(cacheDir, time.Millisecond*200, Options{})
 
 	if err != nil {
 		t.Fatalf("failed to create cache %s", err)
@@ -224,7 +231,8 @@ func TestRefresh(t *testing.T) {
 
 	// verify repeated lookups keep item alive past normal expire
 
-	for i := range []int{1, 2, 3, 4, 5, 6} {
+	start := time.Now()
+	for i := 0; time.Since(start) < 2*config.maxAge; i++ {
 		objdir2, err := config.Lookup("bb", func(objdir string) error {
 			t.Fatalf("unexpected create event, at i=%d", i)
 			// flaky: cache_test.go:229: unexpected create event
@@ -242,6 +250,94 @@ func TestRefresh(t *testing.T) {
 
 }
 
+func TestRefreshAge(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Millisecond*400, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.refreshAge = time.Millisecond * 200
+
+	creates := 0
+	create := func(objdir string) error {
+		creates++
+		return nil
+	}
+	lastUsed := func() time.Time {
+		t.Helper()
+		entries, err := config.List()
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("expected one entry, got %v %v", entries, err)
+		}
+		return entries[0].LastUsed
+	}
+	_, err = config.Lookup("bb", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := lastUsed()
+
+	// frequent lookups within refreshAge keep the timestamp
+	for i := 0; i < 5; i++ {
+		_, err = config.Lookup("bb", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !lastUsed().Equal(first) {
+		t.Fatalf("timestamp refreshed within refreshAge: %s %s", first, lastUsed())
+	}
+
+	// and refresh it after refreshAge, so the item never expires
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 100)
+		_, err = config.Lookup("bb", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.TrimNow()
+	}
+	if creates != 1 {
+		t.Fatalf("expected one create, got %d", creates)
+	}
+	if !lastUsed().After(first) {
+		t.Fatal("timestamp not refreshed after refreshAge")
+	}
+
+	for _, refreshAge := range []time.Duration{0, time.Second, 5 * time.Second} {
+		config, err := NewConfigWithOptions(t.TempDir(), 10*time.Second, Options{RefreshAge: refreshAge})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.refreshAge != max(refreshAge, MinRefreshAge) {
+			t.Fatalf("refresh age %s, expected %s", config.refreshAge, refreshAge)
+		}
+	}
+	_, err = NewConfigWithOptions(t.TempDir(), 10*time.Second, Options{RefreshAge: 6 * time.Second})
+	if err == nil {
+		t.Fatal("expected error for refresh age above maxAge/2")
+	}
+
+	// a reopened cache keeps the maxAge of config.json, and so its refresh age
+	d := t.TempDir()
+	_, err = NewConfig(d, 20*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = NewConfig(d, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.refreshAge != 2*time.Second {
+		t.Fatalf("refresh age %s, expected 2s from config.json", config.refreshAge)
+	}
+	_, err = NewConfigWithOptions(d, time.Hour, Options{RefreshAge: 15 * time.Second})
+	if err == nil {
+		t.Fatal("expected error for refresh age above maxAge/2 of config.json")
+	}
+}
+
 func TestHash(t *testing.T) {
 	// find simple keys that have the same hash (for tests)
 	// GORUN_HASH=a go test -v ./cache -run TestHash
@@ -392,7 +488,7 @@ func TestInternals(t *testing.T) {
 	if obj.age() < 0 {
 		t.Fatal("negative age")
 	}
-	config, err := newConfig(t.TempDir(), time.Millisecond*200)
+	config, err := newConfig(t.TempDir(), time.Millisecond*200, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -417,7 +513,7 @@ func TestDelete(t *testing.T) {
 	t.Parallel()
 	d := t.TempDir()
 
-	config, err := newConfig(d, time.Millisecond*200)
+	config, err := newConfig(d, time.Millisecond*200, Options{Grace: -1})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -429,6 +525,19 @@ func TestDelete(t *testing.T) {
 	time.Sleep(210 * time.Millisecond) // all objects expired by now
 	fmt.Println("---- after sleep 210ms ----")
 
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsScanned != 2 || report.ItemsDeleted != 2 || len(report.Parts) != 2 {
+		t.Fatalf("unexpected trim report %+v", report)
+	}
+	// "some-aa-file" has content "aaaa", plus lockfile and info
+	if report.BytesFreed < 8 {
+		t.Fatalf("expected at least 8 bytes freed, got %d", report.BytesFreed)
+	}
+	expectCountFiles(t, d, "some-", 0)
+
 	createObj(config, "bb")
 
 	config.TrimPeriodically()
@@ -439,174 +548,1822 @@ func TestDelete(t *testing.T) {
 
 }
 
-func createObj(config *Config, hashOfInput string) {
-	_, _ = config.Lookup(hashOfInput, func(objdir string) error {
-		err := os.WriteFile(objdir+"/some-"+hashOfInput+"-file", []byte(hashOfInput+hashOfInput), 0666)
-		if err != nil {
-			panic(err)
-		}
-		log.Printf("create file\n")
-		return nil
-	})
-}
-
-type CmdResult struct {
-	id  int
-	out string
-	err error
-}
+func TestGrace(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
 
-func filter(slist []string, f func(s string) bool) []string {
-	out := []string{}
-	for _, s := range slist {
-		if f(s) {
-			out = append(out, s)
-		}
+	config, err := newConfig(d, 50*time.Millisecond, Options{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	return out
-}
-
-func validLine(s string) bool {
-	s = strings.TrimSpace(s)
-	return s != "" && !strings.HasPrefix(s, "#")
-}
+	config.grace = 5 * time.Second
+	createObj(config, "aa")
+	time.Sleep(100 * time.Millisecond) // expired, but within grace
 
-func shellsplit(s string) []string {
-	// split string on whitespace but quote aware
-	// - useful for subprocess invocation
-	// note: we assume quotes are balanced
-	s = strings.TrimSpace(s)
-	isQuote := func(x byte) bool {
-		return x == '\'' || x == '"'
+	// trim between Lookup and exec must not delete the executable
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
 	}
-	isSpace := func(x byte) bool {
-		return x == '\t' || x == ' '
+	if report.ItemsDeleted != 0 {
+		t.Fatalf("item in grace period deleted: %+v", report)
 	}
-	var q byte
-	q = '.' // = not set
-	// simple quote aware split
+	expectCountFiles(t, d, "some-", 1)
 
-	var begin int = -1 // not field found
-	out := []string{}
-	addfield := func(s string) {
-		if len(s) > 1 && isQuote(s[0]) && isQuote(s[len(s)-1]) {
-			s = s[1 : len(s)-1]
-		}
-		out = append(out, s)
+	config.grace = 0
+	report, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
 	}
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if q == '.' {
-			if isQuote(c) {
-				q = c
-			}
-		} else if q == c {
-			q = '.'
-		}
-		space := q == '.' && isSpace(c)
+	if report.ItemsDeleted != 1 {
+		t.Fatalf("expected expired item deleted without grace: %+v", report)
+	}
+	expectCountFiles(t, d, "some-", 0)
 
-		if begin < 0 {
-			if !space {
-				begin = i
-			}
-		} else {
-			if space {
-				// field found
-				addfield(s[begin:i])
-				begin = -1
-			}
+	for grace, expect := range map[time.Duration]time.Duration{0: DefaultGrace, -time.Second: 0, time.Hour: time.Hour} {
+		config, err := NewConfigWithOptions(t.TempDir(), time.Hour, Options{Grace: grace})
+		if err != nil || config.grace != expect {
+			t.Fatalf("grace %s: expected %s, got %v", grace, expect, err)
 		}
 	}
-	if begin >= 0 {
-		addfield(s[begin:])
-	}
-	return out
 }
 
-func TestShellsplit(t *testing.T) {
-	type Example struct {
-		input  string
-		expect []string
+func TestTrimOrphans(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	examples := []Example{
-		{"", []string{}},
-		{" ", []string{}},
-		{"   ", []string{}},
-		{" a ", []string{"a"}},
-		{"  a  ", []string{"a"}},
-		{"a b", []string{"a", "b"}},
-		{"a 'b ' c", []string{"a", "b ", "c"}},
-		{`a "b " c`, []string{"a", "b ", "c"}},
+	old := time.Now().Add(-2 * time.Hour)
+	itemdir := map[string]string{}
+	for _, input := range []string{"aa", "bb", "cc"} {
+		_, err := config.Lookup(input, func(objdir string) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair := config.itemLock(config.hash(input))
+		itemdir[input] = pair.dir()
 	}
-	for _, x := range examples {
-		actual := shellsplit(x.input)
-		if slices.Compare(actual, x.expect) != 0 {
-			t.Fatalf("input %s - expected %s but got %s", x.input, x.expect, actual)
+	// killed during create => lockfile but no info, old and recent
+	os.Remove(filepath.Join(itemdir["aa"], "info"))
+	os.Chtimes(itemdir["aa"], old, old)
+	os.Remove(filepath.Join(itemdir["bb"], "info"))
+	// unparseable info
+	os.WriteFile(filepath.Join(itemdir["cc"], "info"), []byte("garbage"), 0666)
+	os.Chtimes(itemdir["cc"], old, old)
+
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsDeleted != 2 {
+		t.Fatalf("expected 2 orphans deleted: %+v", report)
+	}
+	for input, expectExists := range map[string]bool{"aa": false, "bb": true, "cc": false} {
+		_, err := os.Stat(itemdir[input])
+		if exists := err == nil; exists != expectExists {
+			t.Errorf("item %s: exists=%v, expected %v", input, exists, expectExists)
 		}
 	}
 }
 
-/*
-run a list of processes in parallel and return the output (stdout+stderr)
-as list of strings, in the same order as submitted, example:
-
-pspec="
-python3 -c 'print(4)'
-python3 -c 'print(5)'
-"
+func TestEvict(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
 
-returns ["4\n", "5\n"]
-*/
+	config, err := newConfig(d, 0, Options{}) // never expire => only evict deletes
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.refreshAge = time.Millisecond // else all items are in grace
+	config.maxBytes = 2500
+	for _, input := range []string{"aa", "bb", "cc"} {
+		_, err := config.Lookup(input, func(objdir string) error {
+			return os.WriteFile(filepath.Join(objdir, "some-"+input), make([]byte, 1000), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond) // distinct refresh times
+	}
 
-func TestProcesslist(t *testing.T) {
-	out := runProcessList(t, `
-	python3 -c 'import time; time.sleep(0.1); print(4)'
-	python3 -c 'print(5)'
-		`)
-	expect := []string{"4\n", "5\n"}
-	if slices.Compare(out, expect) != 0 {
-		t.Fatalf("unexpected output %s", out)
+	config.grace = time.Hour
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsEvicted != 0 {
+		t.Fatalf("items in grace period evicted: %+v", report)
 	}
-}
 
-func runProcessList(t *testing.T, pspec string) []string {
-	resList := runProcessList2(t, pspec)
-	var out []string
-	for _, res := range resList {
-		if res.err != nil {
-			t.Fatalf("runPspec failed: %v %d\n##\n%s ##", res.err, len(res.out), res.out)
+	config.grace = 0
+	report, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsEvicted != 1 || report.ItemsDeleted != 1 || report.BytesFreed < 1000 {
+		t.Fatalf("expected one evicted item, got %+v", report)
+	}
+	for prefix, expect := range map[string]int{"some-aa": 0, "some-bb": 1, "some-cc": 1} {
+		if n := countFiles(d, prefix); n != expect {
+			t.Fatalf("expected %d files %s* but found %d", expect, prefix, n)
 		}
-		out = append(out, res.out)
 	}
-	return out
-}
-func runProcessList2(t *testing.T, pspec string) []CmdResult {
-	plines := filter(strings.Split(pspec, "\n"), validLine)
+	stat, err := config.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.SizeBytes > config.maxBytes {
+		t.Fatalf("cache still %d bytes, limit %d", stat.SizeBytes, config.maxBytes)
+	}
 
-	nproc := len(plines)
-	rx := make(chan CmdResult, nproc)
-	for k := 0; k < nproc; k++ {
-		k := k
-		go func() {
-			args := shellsplit(plines[k])
-			if len(args) > 1 && strings.HasPrefix(args[1], "func=") {
-				args = append(args, fmt.Sprintf("line=%d", k))
-			}
-			cmd := exec.Command(args[0], args[1:]...) //exe, args...)
-			out, err := cmd.CombinedOutput()
-			rx <- CmdResult{k, string(out), err}
-		}()
+	_, err = NewConfigWithLimit(t.TempDir(), time.Hour, -1)
+	if err == nil {
+		t.Fatal("expected error for negative limit")
 	}
+}
 
-	var out []CmdResult = make([]CmdResult, nproc)
-	for k := 0; k < nproc; k++ {
-		select {
-		case res := <-rx:
-			out[res.id] = res
-		case <-time.After(1 * time.Second):
-			t.Fatalf("timeout after 1 sec")
+func TestTrimPeriodicallyLimit(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+
+	// never expire => only the size limit makes a trim pending
+	config, err := NewConfigWithLimit(d, 0, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.refreshAge = time.Millisecond
+	config.grace = 0
+	for _, input := range []string{"aa", "bb", "cc"} {
+		_, err := config.Lookup(input, func(objdir string) error {
+			return os.WriteFile(filepath.Join(objdir, "some-"+input), make([]byte, 1000), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
+		time.Sleep(10 * time.Millisecond) // distinct refresh times
+	}
+	err = config.TrimPeriodically()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(d, "some-"); n != 2 {
+		t.Fatalf("expected the size limit to evict one item, found %d files", n)
+	}
+	if config.trimPending() {
+		t.Fatal("trim pending right after a trim")
 	}
 
-	return out
+	config, err = NewConfig(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.trimPending() {
+		t.Fatal("trim pending without maxAge and size limit")
+	}
+}
+
+func TestEvictPolicy(t *testing.T) {
+	t.Parallel()
+	for policy, evicted := range map[EvictPolicy]string{EvictLRU: "often", EvictLFU: "rare"} {
+		d := t.TempDir()
+		config, err := newConfig(d, 0, Options{Grace: -1}) // never expire => only evict deletes
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.refreshAge != MinRefreshAge {
+			t.Fatalf("refresh age %s without maxAge, expected %s", config.refreshAge, MinRefreshAge)
+		}
+		config.refreshAge = time.Millisecond // each hit refreshes
+		config.maxBytes = 1500
+		config.evictPolicy = policy
+		lookup := func(input string) {
+			t.Helper()
+			_, err := config.Lookup(input, func(objdir string) error {
+				return os.WriteFile(filepath.Join(objdir, "some-"+input), make([]byte, 1000), 0666)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond) // distinct refresh times
+		}
+		lookup("rare")
+		for i := 0; i < 6; i++ {
+			lookup("often")
+		}
+		lookup("rare") // most recently used
+
+		entries, err := config.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		refreshes := map[string]int64{}
+		for _, e := range entries {
+			refreshes[e.Objdir] = e.Refreshes
+		}
+		if len(entries) != 2 || entries[0].SizeBytes < 1000 {
+			t.Fatalf("unexpected entries %+v", entries)
+		}
+
+		report, err := config.TrimNow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ItemsEvicted != 1 {
+			t.Fatalf("policy %d: expected one evicted item, got %+v", policy, report)
+		}
+		for _, input := range []string{"rare", "often"} {
+			expect := 1
+			if input == evicted {
+				expect = 0
+			}
+			if n := countFiles(d, "some-"+input); n != expect {
+				t.Fatalf("policy %d: expected %d files some-%s but found %d, refreshes %v", policy, expect, input, n, refreshes)
+			}
+		}
+	}
+}
+
+func TestRecentHitNoWrite(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	datafile := config.itemLock(config.hash("aa")).datafile
+	before, err := os.Stat(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		createObj(config, "aa")
+	}
+	after, err := os.Stat(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a write replaces the file by rename
+	if !os.SameFile(before, after) {
+		t.Fatal("info rewritten by a hit within the refresh age")
+	}
+}
+
+func TestItemRefreshes(t *testing.T) {
+	t.Parallel()
+	// format of older versions of gorun
+	obj, err := str2item("/x/y 1700000000 5\n")
+	if err != nil || obj.refreshes != 0 {
+		t.Fatalf("got %+v %v", obj, err)
+	}
+	obj.refreshes = 7
+	s := item2str(obj)
+	obj2, err := str2item(s)
+	if err != nil || obj2 != obj {
+		t.Fatalf("got %+v %v, expected %+v", obj2, err, obj)
+	}
+	if !strings.HasPrefix(s, "/x/y 1700000000 5\n") {
+		t.Fatalf("first line must stay readable by older versions: %q", s)
+	}
+	// a bad count is not cache corruption
+	obj, err = str2item("/x/y 1700000000 5\nrefreshes x\n")
+	if err != nil || obj.refreshes != 0 || obj.objdir != "/x/y" {
+		t.Fatalf("got %+v %v", obj, err)
+	}
+}
+
+func TestInitHeals(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+	config, err := newConfig(d, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// crash during init: some part folders and config.json missing
+	for _, part := range []int{0, 17, 255} {
+		err := os.Remove(config.partPrefix(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Remove(config.globalLock().datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = newConfig(d, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectParts := func() {
+		t.Helper()
+		for part := 0; part < 256; part++ {
+			fileinfo, err := os.Stat(config.partPrefix(part))
+			if err != nil || !fileinfo.IsDir() {
+				t.Fatalf("part %d missing: %v", part, err)
+			}
+		}
+	}
+	expectParts()
+	if _, err := os.Stat(config.globalLock().datafile); err != nil {
+		t.Fatalf("config.json not recreated: %v", err)
+	}
+
+	// part folder lost after init
+	err = os.Remove(config.partPrefix(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = newConfig(d, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectParts()
+}
+
+func TestGetInfoParallel(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		_, err := config.Lookup(fmt.Sprintf("item %d", i), func(objdir string) error {
+			return os.WriteFile(filepath.Join(objdir, "main"), make([]byte, rnd.Intn(5000)), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sequential := Stat{}
+	for part := 0; part < 256; part++ {
+		config.GetPartInfo(&sequential, part)
+	}
+	info, err := config.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Count != sequential.Count || info.SizeBytes != sequential.SizeBytes {
+		t.Fatalf("parallel %+v differs from sequential %+v", info, sequential)
+	}
+	if info.Count < 3*300 {
+		t.Fatalf("expected at least 900 files, got %d", info.Count)
+	}
+}
+
+func TestNeverExpire(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+
+	config, err := newConfig(d, 0, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+
+	// make item look very old
+	pair := config.itemLock(hashString("aa"))
+	buf, err := os.ReadFile(pair.datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := str2item(string(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.refreshTime = time.Now().Add(-1000 * time.Hour).Unix()
+	err = os.WriteFile(pair.datafile, []byte(item2str(obj)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.trimPending() {
+		t.Fatal("trim should never be pending when expiry is disabled")
+	}
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsScanned != 1 || report.ItemsDeleted != 0 {
+		t.Fatalf("unexpected trim report %+v", report)
+	}
+	expectCountFiles(t, d, "some-", 1)
+
+	// sentinel is persisted in config.json
+	config2, err := newConfig(d, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config2.expires() {
+		t.Fatalf("expected maxAge never, got %s", config2.maxAge)
+	}
+}
+
+func TestHasher(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+
+	config, err := newConfig(d, time.Hour, Options{Hasher: SHA1Hasher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	_, err = os.Stat(config.itemLock(SHA1Hasher.Sum("aa")).datafile)
+	if err != nil {
+		t.Fatalf("item not keyed by sha1 - %s", err)
+	}
+
+	// a cache must not be mixed across hash algorithms
+	_, err = newConfig(d, time.Hour, Options{})
+	if err == nil {
+		t.Fatal("expected error opening sha1 cache with sha256")
+	}
+}
+
+func TestObjdirCollision(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"11111111", "11111111", "22222222"}
+	config.randFn = func() string {
+		name := names[0]
+		if len(names) > 1 {
+			names = names[1:]
+		}
+		return name
+	}
+
+	// failed create keeps objdir 11111111
+	_, err = config.Lookup("aa", func(objdir string) error {
+		return fmt.Errorf("create failed")
+	})
+	if err == nil {
+		t.Fatal("expected create error")
+	}
+
+	// 11111111 collides => retry with 22222222
+	outdir, err := config.Lookup("aa", func(objdir string) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(outdir) != "22222222" {
+		t.Fatalf("expected retry with new name, got %s", outdir)
+	}
+
+	// all retries collide
+	_, err = config.Lookup("b2", func(objdir string) error {
+		return fmt.Errorf("create failed")
+	})
+	if err == nil {
+		t.Fatal("expected create error")
+	}
+	_, err = config.Lookup("b2", func(objdir string) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "after 10 tries") {
+		t.Fatalf("expected error after retries, got %v", err)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	// not parallel: replaces access
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	createObj(config, "bb")
+
+	issues, err := config.CheckPermissions()
+	if err != nil || len(issues) != 0 {
+		t.Fatalf("expected no issues, got %v %v", issues, err)
+	}
+
+	// simulate entry created by another user
+	unreadable := config.itemLock(hashString("aa")).datafile
+	saveAccess := access
+	defer func() { access = saveAccess }()
+	access = func(path string, mode uint32) error {
+		if path == unreadable {
+			return os.ErrPermission
+		}
+		return saveAccess(path, mode)
+	}
+
+	issues, err = config.CheckPermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Path != unreadable {
+		t.Fatalf("expected issue for %s, got %v", unreadable, issues)
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+	config, err := newConfig(d, time.Millisecond*100, Options{Grace: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	config.AddStats(1, 0)
+	time.Sleep(110 * time.Millisecond)
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := config.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Compiles != 1 || counters.Evictions != 1 {
+		t.Fatalf("unexpected counters %+v", counters)
+	}
+	err = config.ResetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err = config.GetStats()
+	if err != nil || counters.Compiles != 0 || counters.Evictions != 0 {
+		t.Fatalf("expected reset counters, got %+v %v", counters, err)
+	}
+}
+
+func TestMissingParts(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+	config, err := newConfig(d, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "bb")
+
+	// user deletes part folders, including the one with an item
+	for _, hash := range []string{hashString("aa"), hashString("bb"), "00", "ff"} {
+		err := os.RemoveAll(config.partPrefixFromHash(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatalf("trim failed with missing parts - %s", err)
+	}
+	createObj(config, "aa")
+	createObj(config, "bb")
+	expectCountFiles(t, d, "some-", 2)
+
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCountFiles(t, d, "some-", 2)
+}
+
+func benchmarkPart(b *testing.B, list func(partDir string) ([]string, error)) {
+	config, err := newConfig(b.TempDir(), time.Hour, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	partDir := config.partPrefix(0)
+	const nitems = 5000
+	for i := 0; i < nitems; i++ {
+		itemdir := filepath.Join(partDir, hashString(fmt.Sprint(i))[0:40])
+		os.Mkdir(itemdir, 0777)
+		os.WriteFile(filepath.Join(itemdir, "lockfile"), nil, 0666)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		flist, err := list(partDir)
+		if err != nil || len(flist) != nitems {
+			b.Fatalf("expected %d lockfiles, got %d %v", nitems, len(flist), err)
+		}
+	}
+}
+
+func BenchmarkPartGlob(b *testing.B) {
+	benchmarkPart(b, func(partDir string) ([]string, error) {
+		return filepath.Glob(filepath.Join(partDir, "*", "lockfile"))
+	})
+}
+
+func BenchmarkPartReadDir(b *testing.B) {
+	benchmarkPart(b, FileStorage{}.ListItems)
+}
+
+func benchmarkTrim(b *testing.B, workers int) {
+	config, err := newConfig(b.TempDir(), 10*time.Millisecond, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	const nitems = 1000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for k := 0; k < nitems; k++ {
+			_, err := config.Lookup(fmt.Sprint(i, k), func(objdir string) error {
+				return os.WriteFile(filepath.Join(objdir, "some-file"), []byte("x"), 0666)
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond) // expired
+		b.StartTimer()
+		report, err := config.TrimNowWorkers(workers)
+		if err != nil || report.ItemsDeleted != nitems {
+			b.Fatalf("expected %d items deleted, got %d %v", nitems, report.ItemsDeleted, err)
+		}
+	}
+}
+
+func BenchmarkTrimSerial(b *testing.B) {
+	benchmarkTrim(b, 1)
+}
+
+func BenchmarkTrimParallel(b *testing.B) {
+	benchmarkTrim(b, runtime.GOMAXPROCS(0))
+}
+
+func TestFileStorageListItems(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	createObj(config, "pm") // same part as "aa"
+	partDir := config.partPrefixFromHash(hashString("aa"))
+	os.Mkdir(filepath.Join(partDir, "no-lockfile"), 0777)
+
+	expect, err := filepath.Glob(filepath.Join(partDir, "*", "lockfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := FileStorage{}.ListItems(partDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expect) != 2 || slices.Compare(actual, expect) != 0 {
+		t.Fatalf("expected %s but got %s", expect, actual)
+	}
+}
+
+func benchmarkHasher(b *testing.B, hasher Hasher) {
+	input := strings.Repeat("package main\n// some go code\n", 1<<15) // ~1 MB
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		hasher.Sum(input)
+	}
+}
+
+func BenchmarkHashSHA256(b *testing.B) {
+	benchmarkHasher(b, SHA256Hasher)
+}
+
+func BenchmarkHashSHA1(b *testing.B) {
+	benchmarkHasher(b, SHA1Hasher)
+}
+
+func createObj(config *Config, hashOfInput string) {
+	_, _ = config.Lookup(hashOfInput, func(objdir string) error {
+		err := os.WriteFile(objdir+"/some-"+hashOfInput+"-file", []byte(hashOfInput+hashOfInput), 0666)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("create file\n")
+		return nil
+	})
+}
+
+type CmdResult struct {
+	id  int
+	out string
+	err error
+}
+
+func filter(slist []string, f func(s string) bool) []string {
+	out := []string{}
+	for _, s := range slist {
+		if f(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func validLine(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && !strings.HasPrefix(s, "#")
+}
+
+func shellsplit(s string) []string {
+	// split string on whitespace but quote aware
+	// - useful for subprocess invocation
+	// note: we assume quotes are balanced
+	s = strings.TrimSpace(s)
+	isQuote := func(x byte) bool {
+		return x == '\'' || x == '"'
+	}
+	isSpace := func(x byte) bool {
+		return x == '\t' || x == ' '
+	}
+	var q byte
+	q = '.' // = not set
+	// simple quote aware split
+
+	var begin int = -1 // not field found
+	out := []string{}
+	addfield := func(s string) {
+		if len(s) > 1 && isQuote(s[0]) && isQuote(s[len(s)-1]) {
+			s = s[1 : len(s)-1]
+		}
+		out = append(out, s)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if q == '.' {
+			if isQuote(c) {
+				q = c
+			}
+		} else if q == c {
+			q = '.'
+		}
+		space := q == '.' && isSpace(c)
+
+		if begin < 0 {
+			if !space {
+				begin = i
+			}
+		} else {
+			if space {
+				// field found
+				addfield(s[begin:i])
+				begin = -1
+			}
+		}
+	}
+	if begin >= 0 {
+		addfield(s[begin:])
+	}
+	return out
+}
+
+func TestShellsplit(t *testing.T) {
+	type Example struct {
+		input  string
+		expect []string
+	}
+	examples := []Example{
+		{"", []string{}},
+		{" ", []string{}},
+		{"   ", []string{}},
+		{" a ", []string{"a"}},
+		{"  a  ", []string{"a"}},
+		{"a b", []string{"a", "b"}},
+		{"a 'b ' c", []string{"a", "b ", "c"}},
+		{`a "b " c`, []string{"a", "b ", "c"}},
+	}
+	for _, x := range examples {
+		actual := shellsplit(x.input)
+		if slices.Compare(actual, x.expect) != 0 {
+			t.Fatalf("input %s - expected %s but got %s", x.input, x.expect, actual)
+		}
+	}
+}
+
+/*
+run a list of processes in parallel and return the output (stdout+stderr)
+as list of strings, in the same order as submitted, example:
+
+pspec="
+python3 -c 'print(4)'
+python3 -c 'print(5)'
+"
+
+returns ["4\n", "5\n"]
+*/
+
+func TestProcesslist(t *testing.T) {
+	out := runProcessList(t, `
+	python3 -c 'import time; time.sleep(0.1); print(4)'
+	python3 -c 'print(5)'
+		`)
+	expect := []string{"4\n", "5\n"}
+	if slices.Compare(out, expect) != 0 {
+		t.Fatalf("unexpected output %s", out)
+	}
+}
+
+func runProcessList(t *testing.T, pspec string) []string {
+	resList := runProcessList2(t, pspec)
+	var out []string
+	for _, res := range resList {
+		if res.err != nil {
+			t.Fatalf("runPspec failed: %v %d\n##\n%s ##", res.err, len(res.out), res.out)
+		}
+		out = append(out, res.out)
+	}
+	return out
+}
+func runProcessList2(t *testing.T, pspec string) []CmdResult {
+	plines := filter(strings.Split(pspec, "\n"), validLine)
+
+	nproc := len(plines)
+	rx := make(chan CmdResult, nproc)
+	for k := 0; k < nproc; k++ {
+		k := k
+		go func() {
+			args := shellsplit(plines[k])
+			if len(args) > 1 && strings.HasPrefix(args[1], "func=") {
+				args = append(args, fmt.Sprintf("line=%d", k))
+			}
+			cmd := exec.Command(args[0], args[1:]...) //exe, args...)
+			out, err := cmd.CombinedOutput()
+			rx <- CmdResult{k, string(out), err}
+		}()
+	}
+
+	var out []CmdResult = make([]CmdResult, nproc)
+	for k := 0; k < nproc; k++ {
+		select {
+		case res := <-rx:
+			out[res.id] = res
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timeout after 1 sec")
+		}
+	}
+
+	return out
+}
+
+func TestLocations(t *testing.T) {
+	// not parallel: uses t.Setenv
+	if runtime.GOOS != "linux" {
+		t.Skip("fallback chain is os specific")
+	}
+	d := t.TempDir()
+	t.Setenv("GORUN_CACHE", "")
+	t.Setenv("XDG_CACHE_HOME", d)
+	locations := Locations()
+	if len(locations) != 3 {
+		t.Fatalf("expected 3 locations, got %v", locations)
+	}
+	userDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xdg, home := locations[1], locations[2]
+	base := filepath.Join(userDir, "gorun")
+	if !xdg.Active || xdg.Base != base || xdg.Dir != generationDir(base, LayoutVersion) || !xdg.Writable {
+		t.Fatalf("expected active and writable XDG_CACHE_HOME, got %+v", xdg)
+	}
+	if home.Active {
+		t.Fatalf("expected HOME not active, got %+v", home)
+	}
+
+	t.Setenv("XDG_CACHE_HOME", "relative")
+	locations = Locations()
+	if locations[1].Active || locations[1].Dir != "" || !locations[2].Active {
+		t.Fatalf("expected relative XDG_CACHE_HOME to be skipped, got %+v", locations)
+	}
+}
+
+func TestGenerations(t *testing.T) {
+	t.Parallel()
+	base := t.TempDir()
+	v1, err := newGenerationConfig(base, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := newGenerationConfig(base, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []*Config{v1, v2} {
+		_, err := config.Lookup("aa", func(objdir string) error {
+			return os.WriteFile(filepath.Join(objdir, "some-file"), []byte(config.Dir()), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// same input, separate items
+	for _, config := range []*Config{v1, v2} {
+		outdir, err := config.Lookup("aa", func(objdir string) error {
+			t.Error("unexpected create")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(filepath.Join(outdir, "some-file"))
+		if err != nil || string(buf) != config.Dir() || !strings.HasPrefix(outdir, config.Dir()) {
+			t.Fatalf("item of %s not isolated: %s %q %v", config.Dir(), outdir, buf, err)
+		}
+	}
+
+	// unused generations and the layout from before generations are
+	// removed by a trim of another generation
+	legacy, err := newConfig(base, time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.updateTrimRefreshTime(false)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{v1.Dir(), base} {
+		os.Chtimes(filepath.Join(dir, "config.json"), old, old)
+		os.Chtimes(filepath.Join(dir, "trim.txt"), old, old)
+	}
+	_, err = v2.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "v2" {
+		t.Fatalf("expected only generation v2 left, got %q", names)
+	}
+	_, err = v2.Lookup("aa", func(objdir string) error {
+		t.Error("unexpected create")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerationsNotCache(t *testing.T) {
+	t.Parallel()
+	base := t.TempDir()
+	config, err := newGenerationConfig(base, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base set by mistake to a folder with other files: a config.json
+	// without the gorun keys and folders with generation names
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{base, filepath.Join(base, "v1")} {
+		err := os.MkdirAll(filepath.Join(dir, "data"), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, "data", "notes.txt"), []byte("keep"), 0666)
+		os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"name": "other"}`), 0666)
+		os.Chtimes(filepath.Join(dir, "config.json"), old, old)
+	}
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{base, filepath.Join(base, "v1")} {
+		for _, name := range []string{"config.json", "data/notes.txt"} {
+			_, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("removed a file of a folder that is not a cache: %s", err)
+			}
+		}
+	}
+}
+
+func TestGorunCacheEnv(t *testing.T) {
+	// not parallel: uses t.Setenv
+	d := t.TempDir()
+	t.Setenv("GORUN_CACHE", d)
+	config, err := DefaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Dir() != generationDir(d, LayoutVersion) {
+		t.Fatalf("got cache dir %s but expected generation folder in %s", config.Dir(), d)
+	}
+	locations := Locations()
+	if !locations[0].Active || locations[0].Base != d || locations[0].Dir != config.Dir() {
+		t.Fatalf("expected GORUN_CACHE to be active, got %+v", locations)
+	}
+	for _, loc := range locations[1:] {
+		if loc.Active {
+			t.Fatalf("expected only GORUN_CACHE active, got %+v", locations)
+		}
+	}
+
+	t.Setenv("GORUN_CACHE", "relative")
+	_, err = DefaultConfig()
+	if err == nil || !strings.Contains(err.Error(), "GORUN_CACHE must be an absolute path") {
+		t.Fatalf("expected error for relative GORUN_CACHE, got %v", err)
+	}
+	for _, loc := range Locations() {
+		if loc.Active {
+			t.Fatalf("expected no active location, got %+v", loc)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestWriteMetrics(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createObj(config, "aa")
+	createObj(config, "aa")
+
+	var buf syncBuffer
+	err = config.WriteMetrics(&buf, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.WriteMetrics(&buf, time.Second) == nil {
+		t.Fatal("expected error for second metrics writer")
+	}
+	for i := 0; i < 100 && strings.Count(buf.String(), "\n") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	config.Close()
+	n := strings.Count(buf.String(), "\n")
+	time.Sleep(30 * time.Millisecond)
+	if strings.Count(buf.String(), "\n") != n {
+		t.Fatal("metrics written after Close")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected at least two snapshots, got %q", buf.String())
+	}
+	for _, line := range lines {
+		var m Metrics
+		err := json.Unmarshal([]byte(line), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Hits != 1 || m.Misses != 1 || m.Compiles != 1 {
+			t.Fatalf("expected 1 hit, 1 miss and 1 compile, got %+v", m)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.WriteMetrics(io.Discard, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := config.metricsDone
+	for i := 0; i < 2; i++ {
+		err = config.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("metrics goroutine still running after Close")
+	}
+	if config.WriteMetrics(io.Discard, time.Millisecond) == nil {
+		t.Fatal("expected error for WriteMetrics after Close")
+	}
+}
+
+func TestUnsafeReason(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		mode        fs.FileMode
+		owner, euid int
+		unsafe      bool
+	}{
+		{0755, 1000, 1000, false},
+		{0777, 1000, 1000, false}, // own folder
+		{0755, 1001, 1000, false}, // other user, not writable
+		{0777, 1001, 1000, true},
+		{0775, 1001, 1000, false}, // group writable only
+		{0755, 0, 0, false},
+		{0775, 0, 0, true},
+		{0777, 0, 0, true},
+		{0755, 1000, 0, true}, // root runs from user cache
+		{fs.ModeDir | 0755, 0, 0, false},
+	}
+	for _, test := range tests {
+		reason := unsafeReason(test.mode, test.owner, test.euid)
+		if (reason != "") != test.unsafe {
+			t.Errorf("mode %s owner %d euid %d: expected unsafe=%v, got %q", test.mode, test.owner, test.euid, test.unsafe, reason)
+		}
+	}
+}
+
+func TestCheckExec(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exefile string
+	_, err = config.Lookup("aa", func(objdir string) error {
+		exefile = filepath.Join(objdir, "main")
+		return os.WriteFile(exefile, nil, 0755)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.CheckExec(exefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CheckExec("/bin/sh") == nil {
+		t.Fatal("expected error for file outside cache")
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	os.Chmod(filepath.Dir(exefile), 0777)
+	err = config.CheckExec(exefile)
+	if os.Geteuid() == 0 && err == nil {
+		t.Fatal("expected error for root and world-writable folder")
+	}
+	if os.Geteuid() != 0 && err != nil {
+		t.Fatalf("own world-writable folder is safe - %s", err)
+	}
+
+	// a generation config also checks its base folder
+	base := t.TempDir()
+	config, err = newGenerationConfig(base, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Lookup("aa", func(objdir string) error {
+		exefile = filepath.Join(objdir, "main")
+		return os.WriteFile(exefile, nil, 0755)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(base, 0777)
+	err = config.CheckExec(exefile)
+	if os.Geteuid() == 0 && err == nil {
+		t.Fatal("expected error for root and world-writable base folder")
+	}
+}
+
+// countingStorage counts calls to a FileStorage
+type countingStorage struct {
+	FileStorage
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (s *countingStorage) count(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[name]++
+}
+
+func (s *countingStorage) Mkdir(dir string) error {
+	s.count("Mkdir")
+	return s.FileStorage.Mkdir(dir)
+}
+
+func (s *countingStorage) UpdateInfo(datafile string, update func(old string, writeString func(new string) error) error) error {
+	s.count("UpdateInfo")
+	return s.FileStorage.UpdateInfo(datafile, update)
+}
+
+func (s *countingStorage) ListItems(partDir string) ([]string, error) {
+	s.count("ListItems")
+	return s.FileStorage.ListItems(partDir)
+}
+
+func (s *countingStorage) RemoveAll(dir string) error {
+	s.count("RemoveAll")
+	return s.FileStorage.RemoveAll(dir)
+}
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+	storage := &countingStorage{calls: make(map[string]int)}
+	config, err := NewConfigWithOptions(t.TempDir(), 10*time.Second, Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.calls = make(map[string]int) // config.json and part folders
+	createObj(config, "aa")
+	createObj(config, "aa")
+	if storage.calls["Mkdir"] != 1 || storage.calls["UpdateInfo"] != 2 {
+		t.Fatalf("expected lookups through storage, got %v", storage.calls)
+	}
+
+	// expire the item
+	config.maxAge = 10 * time.Millisecond
+	config.refreshAge = time.Millisecond
+	config.grace = 0
+	time.Sleep(20 * time.Millisecond)
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.calls["ListItems"] != 256 || storage.calls["RemoveAll"] != 1 {
+		t.Fatalf("expected trim through storage, got %v", storage.calls)
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+	config, err := NewConfigWithOptions(d, 10*time.Second, Options{Storage: NewMemStorage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creates := 0
+	create := func(objdir string) error {
+		creates++
+		return nil // objdir is only in memory
+	}
+	var objdirs []string
+	for _, input := range []string{"aa", "bb", "aa"} {
+		objdir, err := config.Lookup(input, create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objdirs = append(objdirs, objdir)
+	}
+	if creates != 2 || objdirs[0] != objdirs[2] {
+		t.Fatalf("expected two creates and the same objdir for aa, got %d %v", creates, objdirs)
+	}
+	err = config.Link("tool.go", objdirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := config.List()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected two entries, got %v %v", entries, err)
+	}
+	err = config.AddStats(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := config.GetStats()
+	if err != nil || counters.Compiles != 2 {
+		t.Fatalf("expected 2 compiles, got %+v %v", counters, err)
+	}
+	// only lockfiles on disk
+	for _, name := range []string{"config.json", "info", "stats.json", "README"} {
+		if n := countFiles(d, name); n != 0 {
+			t.Fatalf("expected no %s on disk, found %d", name, n)
+		}
+	}
+
+	config.maxAge = 10 * time.Millisecond
+	config.refreshAge = time.Millisecond
+	config.grace = 0
+	time.Sleep(20 * time.Millisecond)
+	report, err := config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = config.List()
+	if err != nil || len(entries) != 0 || report.ItemsDeleted != 2 {
+		t.Fatalf("expected trim to delete all, got %+v %v %v", report, entries, err)
+	}
+	links, err := config.storage.ReadDir(config.byNameDir())
+	if err != nil || len(links) != 0 {
+		t.Fatalf("expected link to deleted objdir removed, got %v %v", links, err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+	storage := NewMemStorage()
+	config, err := NewConfigWithOptions(t.TempDir(), time.Hour, Options{
+		Grace:       -1,
+		RefreshAge:  time.Minute,
+		Hasher:      SHA1Hasher,
+		Storage:     storage,
+		MaxBytes:    1000,
+		EvictPolicy: EvictLFU,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.grace != 0 || config.refreshAge != time.Minute || config.hasher.Name != SHA1Hasher.Name ||
+		config.storage != storage || config.maxBytes != 1000 || config.evictPolicy != EvictLFU {
+		t.Fatalf("options not combined: %+v", config)
+	}
+
+	for _, opts := range []Options{
+		{Hasher: Hasher{Name: "no-sum"}},
+		{MaxBytes: -1},
+		{EvictPolicy: 7},
+	} {
+		_, err := NewConfigWithOptions(t.TempDir(), time.Hour, opts)
+		if err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+	_, err = NewConfigWithOptions(t.TempDir(), 5*time.Second, Options{})
+	if err == nil {
+		t.Fatal("expected error for maxAge below 10 seconds")
+	}
+}
+
+func TestTrimPeriodicallyHotPath(t *testing.T) {
+	t.Parallel()
+	storage := &countingStorage{calls: make(map[string]int)}
+	config, err := NewConfigWithOptions(t.TempDir(), time.Hour, Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no trim yet => scan all parts
+	err = config.TrimPeriodically()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.calls["ListItems"] != 256 {
+		t.Fatalf("expected first call to trim, got %v", storage.calls)
+	}
+	// within the refresh age => no scan
+	for i := 0; i < 10; i++ {
+		err = config.TrimPeriodically()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storage.calls["ListItems"] != 256 {
+		t.Fatalf("expected no scan within the refresh age, got %v", storage.calls)
+	}
+}
+
+func TestLookupWait(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+	go func() {
+		_, err := config.Lookup("aa", func(outdir string) error {
+			started <- true
+			<-release
+			return nil
+		})
+		done <- err
+	}()
+	<-started
+
+	waitingPid := -1
+	_, err = config.LookupWait("aa", func(outdir string) error {
+		t.Error("unexpected create")
+		return nil
+	}, 50*time.Millisecond, func(pid int) {
+		waitingPid = pid
+	})
+	if !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expected ErrWaitTimeout, got %v", err)
+	}
+	if waitingPid != os.Getpid() {
+		t.Fatalf("expected waiting for pid %d, got %d", os.Getpid(), waitingPid)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.LookupWait("aa", func(outdir string) error {
+		t.Error("unexpected create")
+		return nil
+	}, 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupContext(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+	go func() {
+		_, err := config.Lookup("aa", func(outdir string) error {
+			started <- true
+			<-release
+			return nil
+		})
+		done <- err
+	}()
+	<-started
+
+	// waiting for the lock is aborted
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = config.LookupContext(ctx, "aa", func(outdir string) error {
+		t.Error("unexpected create")
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel during create => no item
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = config.LookupContext(ctx, "bb", func(outdir string) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	created := false
+	_, err = config.Lookup("bb", func(outdir string) error {
+		created = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected create after cancelled lookup")
+	}
+}
+
+func TestCompiling(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(input string, expectPid int, expectActive bool) {
+		t.Helper()
+		owner, active, err := config.Compiling(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner.Pid != expectPid || active != expectActive {
+			t.Fatalf("got pid %d active %v but expected pid %d active %v", owner.Pid, active, expectPid, expectActive)
+		}
+	}
+	check("aa", 0, false)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+	go func() {
+		_, err := config.Lookup("aa", func(outdir string) error {
+			started <- true
+			<-release
+			return nil
+		})
+		done <- err
+	}()
+	<-started
+	check("aa", os.Getpid(), true)
+	owner, _, _ := config.Compiling("aa")
+	if host, _ := os.Hostname(); owner.Host != host {
+		t.Fatalf("got host %q but expected %q", owner.Host, host)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	check("aa", 0, false)
+
+	// owner left behind by a crashed compile
+	config.writeOwner(config.itemLock(config.hash("aa")).lockfile)
+	check("aa", os.Getpid(), false)
+}
+
+func TestLink(t *testing.T) {
+	t.Parallel()
+	config, err := NewConfig(t.TempDir(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objdir := func(input string) string {
+		t.Helper()
+		objdir, err := config.Lookup(input, func(objdir string) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return objdir
+	}
+	resolve := func(name string) string {
+		t.Helper()
+		dir, err := filepath.EvalSymlinks(filepath.Join(config.byNameDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	a, b := objdir("aa"), objdir("bb")
+	err = config.Link("my tool.go", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, _ := filepath.EvalSymlinks(a); resolve("my_tool.go") != dir {
+		t.Fatalf("my_tool.go resolves to %s, expected %s", resolve("my_tool.go"), a)
+	}
+	// the last link of a name wins
+	err = config.Link("my tool.go", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, _ := filepath.EvalSymlinks(b); resolve("my_tool.go") != dir {
+		t.Fatalf("my_tool.go resolves to %s, expected %s", resolve("my_tool.go"), b)
+	}
+	for _, bad := range []string{"..", ""} {
+		if config.Link(bad, a) == nil {
+			t.Errorf("expected error for name %q", bad)
+		}
+	}
+	if config.Link("other", t.TempDir()) == nil {
+		t.Error("expected error for a folder outside the cache")
+	}
+
+	// removed with the objdir
+	config.maxAge = 10 * time.Millisecond
+	config.refreshAge = time.Millisecond
+	config.grace = 0
+	time.Sleep(20 * time.Millisecond)
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(config.byNameDir())
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no links after trim, got %v %v", entries, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+	config, err := NewConfig(t.TempDir(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no such item => no-op
+	err = config.Purge("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creates := 0
+	create := func(objdir string) error {
+		creates++
+		return nil
+	}
+	objdir, err := config.Lookup("aa", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Lookup("bb", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Purge("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(objdir)); !os.IsNotExist(err) {
+		t.Fatalf("item folder of aa not removed: %v", err)
+	}
+	_, err = config.Lookup("aa", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Lookup("bb", create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creates != 3 {
+		t.Fatalf("expected aa created again and bb kept, got %d creates", creates)
+	}
+}
+
+func TestLockFallback(t *testing.T) {
+	t.Parallel()
+	noLock := func(file *os.File, lockType LockType) error {
+		return fmt.Errorf("flock: %w", errors.ErrUnsupported)
+	}
+
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// strict by default: a lock that fails aborts
+	config.locker = locker{lock: noLock}
+	_, err = config.Lookup("aa", func(objdir string) error {
+		return nil
+	})
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected lock error, got %v", err)
+	}
+
+	warnings := 0
+	warn := func(lockfile string, err error) {
+		warnings++
+	}
+	config.locker = locker{lock: noLock, fallback: true, warn: warn}
+	creates := 0
+	for i := 0; i < 2; i++ {
+		outdir, err := config.Lookup("aa", func(objdir string) error {
+			creates++
+			return os.WriteFile(filepath.Join(objdir, "some-file"), []byte("x"), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectCountFiles(t, outdir, "some-", 1)
+	}
+	if creates != 1 {
+		t.Fatalf("expected one create without locks, got %d", creates)
+	}
+	if warnings == 0 {
+		t.Fatal("expected a warning for the failed locks")
+	}
+	_, err = config.TrimNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateDatafileShorter(t *testing.T) {
+	t.Parallel()
+	d := t.TempDir()
+	datafile := filepath.Join(d, "info")
+	for _, s := range []string{"a long first line\nand more\n", "short\n", ""} {
+		err := updateDatafile(datafile, func(old string, writeString func(new string) error) error {
+			return writeString(s)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(datafile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != s {
+			t.Fatalf("expected %q but found %q", s, buf)
+		}
+	}
+	// no temp file is left behind
+	entries, err := os.ReadDir(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only info in %s, found %d files", d, len(entries))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdir := map[string]string{}
+	for _, input := range []string{"good", "empty", "missing", "garbage"} {
+		outdir[input], err = config.Lookup(input, func(objdir string) error {
+			os.WriteFile(filepath.Join(objdir, "main.go"), []byte("package main\n"), 0666)
+			return os.WriteFile(filepath.Join(objdir, "main"), []byte("exe"), 0777)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// full disk: main.go but an empty main
+	os.WriteFile(filepath.Join(outdir["empty"], "main"), nil, 0777)
+	os.RemoveAll(outdir["missing"])
+	os.WriteFile(filepath.Join(filepath.Dir(outdir["garbage"]), "info"), []byte("garbage"), 0666)
+
+	report, err := config.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsScanned != 4 || len(report.Broken) != 3 || report.ItemsDeleted != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, input := range []string{"empty", "missing", "garbage"} {
+		if !slices.ContainsFunc(report.Broken, func(b BrokenItem) bool { return b.Itemdir == filepath.Dir(outdir[input]) }) {
+			t.Fatalf("expected %s broken: %+v", input, report)
+		}
+	}
+
+	report, err = config.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsDeleted != 3 {
+		t.Fatalf("expected 3 items deleted: %+v", report)
+	}
+	report, err = config.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ItemsScanned != 1 || len(report.Broken) != 0 {
+		t.Fatalf("expected only the good item left: %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(outdir["good"], "main")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+	config, err := newConfig(t.TempDir(), time.Hour, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdir := map[string]string{}
+	for _, input := range []string{"aa", "bb", "cc"} {
+		outdir[input], err = config.Lookup(input, func(objdir string) error {
+			return os.WriteFile(filepath.Join(objdir, "some-file"), []byte("1234"), 0666)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(filepath.Dir(outdir["cc"]), "info"), []byte("garbage"), 0666)
+
+	var found []string
+	err = config.Walk(func(entry Entry) error {
+		found = append(found, entry.Objdir)
+		if entry.SizeBytes < 4 || entry.Age < 0 || entry.Age > time.Minute {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		if entry.Objdir != outdir["aa"] {
+			return nil
+		}
+		// not called under the part lock
+		return config.Purge("aa")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(found)
+	expect := []string{outdir["aa"], outdir["bb"]}
+	slices.Sort(expect)
+	if slices.Compare(found, expect) != 0 {
+		t.Fatalf("expected %v without the unparseable item, got %v", expect, found)
+	}
+	if _, err := os.Stat(outdir["aa"]); !os.IsNotExist(err) {
+		t.Fatalf("expected purge during walk, got %v", err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = config.Walk(func(entry Entry) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected walk stopped by error, got %v after %d calls", err, calls)
+	}
 }
@@ -6,24 +6,42 @@ package cache
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
-
-	"github.com/bir3/gocompiler/extra"
 )
 
 type Config struct {
-	dir string // no trailing slashes
+	dir  string // no trailing slashes
+	base string // parent of the generation folder dir, see NewGenerationConfig
+
+	maxAge     time.Duration // safe to delete objects older than this, zero = never expire
+	refreshAge time.Duration // Lookup refreshes the timestamp of older objects, see Options.RefreshAge
+	grace      time.Duration // objects used more recently are never deleted, see Options.Grace
+	hasher     Hasher
+	randFn     func() string // random hex for new objdir names, injectable by tests
+	re1        *regexp.Regexp
+	re2        *regexp.Regexp
+
+	storage Storage
+	locker  locker // strict unless Options.LockFallback
 
-	maxAge time.Duration // safe to delete objects older than this
-	re1    *regexp.Regexp
-	re2    *regexp.Regexp
+	maxBytes    int64       // TrimNow evicts objects above this total size, zero = no limit
+	evictPolicy EvictPolicy // which objects evict deletes first
+
+	metrics      metrics       // lookups by this process
+	metricsMutex sync.Mutex    // protects metricsStop and closed
+	metricsStop  chan struct{} // closed by Close to stop WriteMetrics
+	metricsDone  chan struct{}
+	closed       bool
 }
 type Lockpair struct {
 	lockfile string
@@ -81,26 +99,132 @@ func (config *Config) partPrefixFromHash(hash string) string {
 	return config.partPrefix(int(i))
 }
 
+// NewConfig opens or creates a cache in dir.
+// A maxAge of zero disables age-based expiry: items are then only
+// removed by explicit deletes.
 func NewConfig(dir string, maxAge time.Duration) (*Config, error) {
+	return NewConfigWithOptions(dir, maxAge, Options{})
+}
+
+// DefaultGrace is the grace period of NewConfig
+const DefaultGrace = time.Minute
+
+// MinRefreshAge is the smallest Options.RefreshAge
+const MinRefreshAge = time.Second
+
+// EvictPolicy selects the items that TrimNow deletes first to get below
+// the size limit of Options.MaxBytes
+type EvictPolicy int
+
+const (
+	EvictLRU EvictPolicy = iota // least recently used first, the default
+	EvictLFU                    // fewest refreshes first, then least recently used, see Entry.Refreshes
+)
+
+// Options are the settings of NewConfigWithOptions, they can be combined.
+// The zero value is the cache of NewConfig.
+type Options struct {
+	// Grace: a trim never deletes an item returned by Lookup within the
+	// last grace period, even if older than maxAge. This protects an
+	// executable between Lookup and exec.
+	// Zero is DefaultGrace, negative is no grace period.
+	Grace time.Duration
+
+	// RefreshAge: Lookup refreshes the timestamp of an item, and
+	// TrimPeriodically checks for a trim, when older than RefreshAge.
+	// A longer RefreshAge writes less often, a shorter keeps recently used
+	// items more exact. Zero is maxAge/10. The refresh age is at least
+	// MinRefreshAge and at most maxAge/2, so that a used item is refreshed
+	// before it expires. maxAge is the one of config.json for an existing cache.
+	// Without maxAge, the refresh age is MinRefreshAge.
+	RefreshAge time.Duration
+
+	// Hasher computes the cache keys, SHA256Hasher if zero. The hasher
+	// name is recorded in config.json and a cache created with one hasher
+	// can not be opened with another.
+	Hasher Hasher
+
+	// Storage keeps the items and the other files of the cache, e.g.
+	// MemStorage for tests; FileStorage if nil
+	Storage Storage
+
+	// MaxBytes: TrimNow also deletes items by EvictPolicy while the cache
+	// is larger than MaxBytes. Zero is no limit.
+	MaxBytes    int64
+	EvictPolicy EvictPolicy
+
+	// LockFallback: a file lock that fails, e.g. on a network filesystem
+	// without flock, only warns once on stderr and the cache is used
+	// without that lock. Concurrent processes may then compile the same
+	// item twice or trim an item in use.
+	LockFallback bool
+}
 
-	if maxAge < 10*time.Second {
+// NewConfigWithOptions is like NewConfig with the settings of opts
+func NewConfigWithOptions(dir string, maxAge time.Duration, opts Options) (*Config, error) {
+	if maxAge != 0 && maxAge < 10*time.Second {
 		return nil, fmt.Errorf("maxAge minimum is 10 seconds")
 	}
-	return newConfig(dir, maxAge)
+	return newConfig(dir, maxAge, opts)
 }
 
-func writeREADME(dir string) {
+// NewConfigWithLimit is like NewConfig but TrimNow also deletes the least
+// recently used items while the cache is larger than maxBytes.
+// A maxBytes of zero means no limit.
+func NewConfigWithLimit(dir string, maxAge time.Duration, maxBytes int64) (*Config, error) {
+	return NewConfigWithOptions(dir, maxAge, Options{MaxBytes: maxBytes})
+}
+
+// MaxAge returns the age after which items expire, zero if never
+func (config *Config) MaxAge() time.Duration {
+	return config.maxAge
+}
+
+// MaxBytes returns the size limit of the cache, zero if none
+func (config *Config) MaxBytes() int64 {
+	return config.maxBytes
+}
+
+func (config *Config) writeREADME() {
 	s := `
 cache folder maintained by https://github.com/bir3/gorun
 	`
 	s = strings.TrimSpace(s) + "\n"
-	os.WriteFile(filepath.Join(dir, "README"), []byte(s), 0666)
+	config.storage.WriteFile(filepath.Join(config.dir, "README"), []byte(s))
 }
 
-func newConfig(dir string, maxAge time.Duration) (*Config, error) {
-	if maxAge < 10*time.Millisecond {
+// newConfig is NewConfigWithOptions with a maxAge minimum of 10
+// milliseconds, for tests
+func newConfig(dir string, maxAge time.Duration, opts Options) (*Config, error) {
+	if maxAge != 0 && maxAge < 10*time.Millisecond {
 		return nil, fmt.Errorf("internal maxAge minimum is 10 milliseconds")
 	}
+	hasher := opts.Hasher
+	if hasher.Name == "" && hasher.Sum == nil {
+		hasher = SHA256Hasher
+	}
+	if hasher.Name == "" || hasher.Sum == nil {
+		return nil, fmt.Errorf("hasher must have a name and a sum function")
+	}
+	if opts.MaxBytes < 0 {
+		return nil, fmt.Errorf("negative size limit: %d", opts.MaxBytes)
+	}
+	if opts.EvictPolicy != EvictLRU && opts.EvictPolicy != EvictLFU {
+		return nil, fmt.Errorf("unknown evict policy %d", opts.EvictPolicy)
+	}
+	storage := opts.Storage
+	if storage == nil {
+		storage = FileStorage{}
+	}
+	var l locker
+	if opts.LockFallback {
+		var once sync.Once
+		l = locker{fallback: true, warn: func(lockfile string, err error) {
+			once.Do(func() {
+				fmt.Fprintf(os.Stderr, "gorun: warning: cache used without file locks - %s\n", err)
+			})
+		}}
+	}
 
 	if !utf8.Valid([]byte(dir)) {
 		return nil, fmt.Errorf("config dir is not utf8: %q", dir)
@@ -110,15 +234,33 @@ func newConfig(dir string, maxAge time.Duration) (*Config, error) {
 		return nil, fmt.Errorf("bad characters in config dir : %q", dir)
 	}
 
-	config := &Config{dir, maxAge, regexp.MustCompile(`^[a-z0-9]{2}-t$`), regexp.MustCompile(`^[a-z0-9]{40}$`)}
+	config := &Config{
+		dir:    dir,
+		maxAge: maxAge,
+		hasher: hasher,
+		randFn: randomHash,
+		re1:    regexp.MustCompile(`^[a-z0-9]{2}-t$`),
+		re2:    regexp.MustCompile(`^[a-z0-9]{40}$`),
+
+		storage: storage,
+		locker:  l,
 
-	extra.MkdirAllRace(dir, 0777)
+		grace:       DefaultGrace,
+		maxBytes:    opts.MaxBytes,
+		evictPolicy: opts.EvictPolicy,
+	}
+	if opts.Grace != 0 {
+		config.grace = max(opts.Grace, 0)
+	}
+
+	config.storage.MkdirAll(dir)
 
 	m := make(map[string]string)
 
 	updateContent := func(old string, writeString func(new string) error) error {
-		m["maxAge"] = maxAge.String()
-		m["#info-maxAge"] = "valid units are h, m and s"
+		m["maxAge"] = formatMaxAge(maxAge)
+		m["#info-maxAge"] = "valid units are h, m and s or never"
+		m["hash"] = hasher.Name
 
 		final, err := jsonString(m)
 		if err != nil {
@@ -126,21 +268,12 @@ func newConfig(dir string, maxAge time.Duration) (*Config, error) {
 		}
 
 		if old == "" { // = no existing file
-			prefix := config.prefix()
-			err := ensureDir(prefix)
+			err := config.ensurePartDirs()
 			if err != nil {
 				return err
 			}
-			// create subdirs
-			for i := 0; i < 256; i++ {
-				name := config.partPrefix(i)
-				err := ensureDir(name)
-				if err != nil {
-					return err
-				}
-			}
 
-			writeREADME(dir)
+			config.writeREADME()
 
 			return writeString(final)
 		} else {
@@ -149,34 +282,149 @@ func newConfig(dir string, maxAge time.Duration) (*Config, error) {
 			if err != nil {
 				return err
 			}
-			maxAge, err = time.ParseDuration(m["maxAge"])
+			maxAge, err = parseMaxAge(m["maxAge"])
 			if err != nil {
 				return err
 			}
-			if maxAge < time.Second*10 {
+			if maxAge != 0 && maxAge < time.Second*10 {
 				return fmt.Errorf("maxAge too short: %s", maxAge)
 			}
 			config.maxAge = maxAge
+
+			// cache created before hash was recorded => sha256
+			hashName := m["hash"]
+			if hashName == "" {
+				hashName = SHA256Hasher.Name
+			}
+			if hashName != hasher.Name {
+				return fmt.Errorf("cache %s uses hash %s, not %s", dir, hashName, hasher.Name)
+			}
 		}
 
 		return nil
 	}
 
+	// an existing config.json is only read: a shared lock does not wait
+	// for compiles in other processes, as they hold a shared lock too
 	g := config.globalLock()
-	err := UpdateMultiprocess(g.lockfile, EXCLUSIVE_LOCK, g.datafile, updateContent)
+	old := ""
+	err := config.locker.lockedfile(g.lockfile, SHARED_LOCK, func() error {
+		buf, err := config.storage.ReadFile(g.datafile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		old = string(buf)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-
+	if old != "" {
+		err = updateContent(old, func(string) error {
+			return fmt.Errorf("internal error: config.json is read-only here")
+		})
+		if err == nil {
+			// heal part folders lost after config.json was written
+			err = config.ensurePartDirs()
+		}
+	} else {
+		err = config.updateFile(g, updateContent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// maxAge may come from config.json
+	if config.maxAge == 0 {
+		// no expiry: the timestamp only orders the items to evict, so a
+		// hit need not write it every time
+		config.refreshAge = MinRefreshAge
+	} else {
+		config.refreshAge = min(max(config.maxAge/10, MinRefreshAge), config.maxAge/2)
+	}
+	if opts.RefreshAge != 0 {
+		// check against the maxAge of config.json, not the argument
+		if config.maxAge == 0 {
+			return nil, fmt.Errorf("refresh age needs a maxAge")
+		}
+		refreshAge := max(opts.RefreshAge, MinRefreshAge)
+		if refreshAge > config.maxAge/2 {
+			return nil, fmt.Errorf("refresh age %s is more than half of maxAge %s", refreshAge, config.maxAge)
+		}
+		config.refreshAge = refreshAge
+	}
 	return config, nil
 }
 
+// updateFile is like UpdateMultiprocess for a file of the storage,
+// e.g. config.json
+func (config *Config) updateFile(pair Lockpair, updateContent func(old string, writeString func(new string) error) error) error {
+	return config.locker.lockedfile(pair.lockfile, EXCLUSIVE_LOCK, func() error {
+		return config.storage.UpdateInfo(pair.datafile, updateContent)
+	})
+}
+
+// ensurePartDirs creates any missing part folder
+// - config.json is written last, so a crash during init is healed by
+// the next newConfig
+// - processes may race here under a shared lock
+func (config *Config) ensurePartDirs() error {
+	dirs := []string{config.prefix()}
+	for i := 0; i < 256; i++ {
+		dirs = append(dirs, config.partPrefix(i))
+	}
+	for _, dir := range dirs {
+		err := config.ensureDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatMaxAge(maxAge time.Duration) string {
+	if maxAge == 0 {
+		return "never"
+	}
+	return maxAge.String()
+}
+
+func parseMaxAge(s string) (time.Duration, error) {
+	if s == "never" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// expires is false if items never expire by age
+func (config *Config) expires() bool {
+	return config.maxAge != 0
+}
+
+// Close stops background goroutines, e.g. from WriteMetrics.
+// The config must not be used after Close. Safe to call more than once.
+// Short-lived processes need not call Close.
+func (config *Config) Close() error {
+	config.stopMetrics()
+	config.metricsMutex.Lock()
+	config.closed = true
+	config.metricsMutex.Unlock()
+	return nil
+}
+
+// DefaultConfig opens the cache generation of LayoutVersion in
+// $GORUN_CACHE if set, else in the gorun folder of os.UserCacheDir
 func DefaultConfig() (*Config, error) {
 	maxAge := 10 * 24 * time.Hour
+	if dir := os.Getenv("GORUN_CACHE"); dir != "" {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("GORUN_CACHE must be an absolute path, got %q", dir)
+		}
+		return NewGenerationConfig(dir, maxAge)
+	}
 	dir, err := os.UserCacheDir()
 	if err != nil {
 		return nil, err
 	}
 	dir = filepath.Join(dir, "gorun")
-	return NewConfig(dir, maxAge)
+	return NewGenerationConfig(dir, maxAge)
 }
@@ -9,10 +9,39 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 )
 
+// TrimReport describes the work done by TrimNow
+type TrimReport struct {
+	ItemsScanned int
+	ItemsDeleted int
+	ItemsEvicted int // part of ItemsDeleted: not expired, deleted for maxBytes
+	BytesFreed   int64
+	Parts        []PartReport // only parts with items, expired items only
+}
+
+type PartReport struct {
+	Part         int
+	ItemsScanned int
+	ItemsDeleted int
+	BytesFreed   int64
+}
+
+func (report *TrimReport) add(p PartReport) {
+	report.ItemsScanned += p.ItemsScanned
+	report.ItemsDeleted += p.ItemsDeleted
+	report.BytesFreed += p.BytesFreed
+	if p.ItemsScanned > 0 {
+		report.Parts = append(report.Parts, p)
+	}
+}
+
 func (config *Config) safeRemoveAll2(datafile, objdir string) error {
-	err := os.Remove(datafile)
+	err := config.storage.RemoveInfo(datafile)
 	if err == nil || errors.Is(err, os.ErrNotExist) {
 		return config.safeRemoveAll(objdir)
 	}
@@ -35,14 +64,18 @@ func (config *Config) safeRemoveAll(objdir string) error {
 		!config.re2.MatchString(filepath.Base(d2)) {
 		return fmt.Errorf("removeAll: bad objdir %s", objdir)
 	}
-	return os.RemoveAll(objdir)
+	return config.storage.RemoveAll(objdir)
 }
 
 func (config *Config) trimPending() bool {
 	// return true if we should trim/delete old objects
 	// - if any error, we return true
+	// - never true if items do not expire by age and there is no size limit
 
-	buf, err := os.ReadFile(config.trimLock().datafile) // unix timestamp of last trim
+	if !config.expires() && config.maxBytes == 0 {
+		return false
+	}
+	buf, err := config.storage.ReadFile(config.trimLock().datafile) // unix timestamp of last trim
 	if err != nil {
 		return true
 	} else {
@@ -50,10 +83,25 @@ func (config *Config) trimPending() bool {
 		if err != nil {
 			return true
 		}
-		return item.age() > config.maxAge/10
+		return item.age() > config.trimInterval()
+	}
+}
+
+// limitTrimInterval is the trim interval of a cache with a size limit
+// whose items never expire by age
+const limitTrimInterval = time.Hour
+
+// trimInterval is the time between trims of TrimPeriodically
+func (config *Config) trimInterval() time.Duration {
+	if !config.expires() {
+		return limitTrimInterval
 	}
+	return config.refreshAge
 }
 
+// TrimPeriodically runs TrimNow if no trim has run within the refresh
+// age, or within an hour for a size limit without maxAge. The common case is one read of trim.txt, without locks or a scan
+// of the parts, so it is cheap to call on every compile.
 func (config *Config) TrimPeriodically() error {
 
 	if !config.trimPending() {
@@ -68,7 +116,8 @@ func (config *Config) TrimPeriodically() error {
 		return err
 	}
 	if runTrim {
-		return config.TrimNow()
+		_, err = config.TrimNow()
+		return err
 	}
 	return nil
 }
@@ -84,7 +133,7 @@ func (config *Config) updateTrimRefreshTime(checkIfRefreshNeeded bool) (bool, er
 		item := Item{}
 		item.objdir = "/gorun/trim"
 		item.refresh()
-		err := os.WriteFile(pair.datafile, []byte(item2str(item)), 0666)
+		err := config.storage.WriteFile(pair.datafile, []byte(item2str(item)))
 		if err != nil {
 			return err
 		}
@@ -92,42 +141,95 @@ func (config *Config) updateTrimRefreshTime(checkIfRefreshNeeded bool) (bool, er
 		return nil
 	}
 
-	err := Lockedfile(pair.lockfile, EXCLUSIVE_LOCK, withLock)
+	err := config.locker.lockedfile(pair.lockfile, EXCLUSIVE_LOCK, withLock)
 	return updated, err
 }
 
-func (config *Config) TrimNow() error {
+func (config *Config) TrimNow() (TrimReport, error) {
+	return config.TrimNowWorkers(runtime.GOMAXPROCS(0))
+}
+
+// TrimNowWorkers is like TrimNow but trims up to workers parts in
+// parallel, each under its own part lock
+func (config *Config) TrimNowWorkers(workers int) (TrimReport, error) {
 	var saveError error
+	var report TrimReport
 
+	// in part order, for the same report and first error as one worker
+	partReports := make([]PartReport, 256)
+	partErrors := make([]error, 256)
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range parts {
+				partReports[k], partErrors[k] = config.deleteExpiredPart(k)
+			}
+		}()
+	}
 	for k := 0; k < 256; k++ {
-		err := config.deleteExpiredPart(k)
+		parts <- k
+	}
+	close(parts)
+	wg.Wait()
+	for k := 0; k < 256; k++ {
+		report.add(partReports[k])
+		if partErrors[k] != nil && saveError == nil {
+			saveError = partErrors[k]
+		}
+	}
+	// once, not per part: workers would contend for trim.lock
+	checkIfRefreshNeeded := false
+	_, err := config.updateTrimRefreshTime(checkIfRefreshNeeded)
+	if err != nil && saveError == nil {
+		saveError = err
+	}
+	err = config.trimGenerations()
+	if err != nil && saveError == nil {
+		saveError = err
+	}
+	if config.maxBytes > 0 {
+		err := config.evict(&report)
 		if err != nil && saveError == nil {
 			saveError = err
 		}
-		checkIfRefreshNeeded := false
-		_, err = config.updateTrimRefreshTime(checkIfRefreshNeeded)
+	}
+	err = config.trimLinks()
+	if err != nil && saveError == nil {
+		saveError = err
+	}
+	if report.ItemsDeleted > 0 {
+		err := config.AddStats(0, report.ItemsDeleted)
 		if err != nil && saveError == nil {
 			saveError = err
 		}
 	}
 
-	return saveError
+	return report, saveError
 
 }
 
-func (config *Config) deleteExpiredPart(part int) error {
+func (config *Config) deleteExpiredPart(part int) (PartReport, error) {
 	// we run under an exclusive lock on our part of the cache
 
+	report := PartReport{Part: part}
+
+	exists, err := config.storage.Exists(config.partPrefix(part))
+	if err == nil && !exists {
+		// part folder deleted by user => nothing to trim
+		// - Lookup2 recreates it when needed
+		return report, nil
+	}
+
 	withPartLock := func() error {
 		// we must only search for lockfiles under an exclusive lock
 		// as otherwise an item being created may only have reached
 		// the point of creating the lockfile and not yet locked it
-		glob := filepath.Join(config.partPrefix(part), "*", "lockfile")
-
-		flist, err := filepath.Glob(glob)
-
+		flist, err := config.storage.ListItems(config.partPrefix(part))
 		if err != nil {
-			return fmt.Errorf("glob failed - %w", err)
+			return fmt.Errorf("list lockfiles failed - %w", err)
 		}
 
 		// NOTE: deleting lockfile is never safe, except under a higher lock,
@@ -135,45 +237,194 @@ func (config *Config) deleteExpiredPart(part int) error {
 		// and file could be deleted before we lock (partLock here prevents that)
 		var saveError error
 		for _, lockfile := range flist {
-			err = config.deleteHash(lockfile)
+			report.ItemsScanned++
+			var deleted bool
+			var freed int64
+			deleted, freed, err = config.deleteHash(lockfile)
+			if deleted {
+				report.ItemsDeleted++
+				report.BytesFreed += freed
+			}
 
 			if err != nil {
-				saveError = fmt.Errorf("error during delete of %s : %s", lockfile, err)
+				saveError = fmt.Errorf("error during delete of %s : %w", lockfile, err)
 			}
 		}
 		return saveError
 	}
 	hash := fmt.Sprintf("%02x", part)
-	return Lockedfile(config.partLock(hash).lockfile, EXCLUSIVE_LOCK, withPartLock)
+	err = config.locker.lockedfile(config.partLock(hash).lockfile, EXCLUSIVE_LOCK, withPartLock)
+	return report, err
+}
+
+// inGrace is true if an item of this age may have been returned by
+// Lookup within the grace period: Lookup only refreshes the timestamp
+// of an item older than refreshAge
+func (config *Config) inGrace(age time.Duration) bool {
+	return age <= config.refreshAge+config.grace
 }
 
-func (config *Config) deleteHash(lockfile string) error {
+// deleteHash returns if the item was deleted and the number of bytes freed
+func (config *Config) deleteHash(lockfile string) (bool, int64, error) {
 	datafile := lockfile2datafile(lockfile)
+	itemdir := filepath.Dir(lockfile)
 
-	buf, err := os.ReadFile(datafile)
+	buf, err := config.storage.ReadInfo(datafile)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return config.safeRemoveAll(filepath.Dir(lockfile))
+			// create failed or process killed, folder kept for debug
+			return config.deleteOrphan(itemdir, nil)
 		}
-		return err
+		return false, 0, err
 	}
 
-	obj, err := str2item(string(buf))
+	obj, err := str2item(buf)
 	if err != nil {
-		// unknown format => avoid deletion
-		return err
+		// unknown format => only delete when old
+		return config.deleteOrphan(itemdir, err)
 	}
 
-	if obj.age() > config.maxAge {
+	if config.expires() && obj.age() > config.maxAge && !config.inGrace(obj.age()) {
+		_, size := config.storage.Usage(itemdir)
 		// important to first delete datafile
 		// - must exist since we just read it
-		err = os.Remove(datafile)
+		err = config.storage.RemoveInfo(datafile)
 		if err != nil {
-			return err
+			return false, 0, err
 		}
 
 		// delete all files, including lockfile
-		return config.safeRemoveAll(filepath.Dir(lockfile))
+		return true, size, config.safeRemoveAll(itemdir)
 	}
-	return nil
+	return false, 0, nil
+}
+
+// deleteOrphan deletes an item folder without a valid info datafile if
+// the folder is older than maxAge, else returns infoErr
+// - caller must hold the exclusive part lock, so no create is in progress
+func (config *Config) deleteOrphan(itemdir string, infoErr error) (bool, int64, error) {
+	if !config.expires() {
+		return false, 0, infoErr
+	}
+	mtime, err := config.storage.ModTime(itemdir)
+	if err != nil {
+		return false, 0, err
+	}
+	if time.Since(mtime) <= config.maxAge {
+		return false, 0, infoErr
+	}
+	_, size := config.storage.Usage(itemdir)
+	return true, size, config.safeRemoveAll(itemdir)
+}
+
+// Purge deletes the item of input, e.g. to force a new create of a
+// miscompiled program. No error if there is no such item.
+func (config *Config) Purge(input string) error {
+	hs := config.hash(input)
+	pair := config.itemLock(hs)
+	withPartLock := func() error {
+		// exclusive part lock => no Lookup holds the item
+		err := config.storage.RemoveInfo(pair.datafile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		exists, err := config.storage.Exists(pair.dir())
+		if err != nil || !exists {
+			return err
+		}
+		// the item folder, including lockfile
+		return config.safeRemoveAll(pair.dir())
+	}
+	withGlobalLock := func() error {
+		return config.locker.lockedfile(config.partLock(hs).lockfile, EXCLUSIVE_LOCK, withPartLock)
+	}
+	err := config.locker.lockedfile(config.globalLock().lockfile, SHARED_LOCK, withGlobalLock)
+	if err != nil {
+		return fmt.Errorf("purge of %s failed - %w", pair.dir(), err)
+	}
+	return config.trimLinks()
+}
+
+// evict deletes items by evictPolicy until the cache holds at most
+// maxBytes. Items in their grace period are kept, so the cache may
+// stay larger.
+func (config *Config) evict(report *TrimReport) error {
+	stat, err := config.GetInfo()
+	if err != nil {
+		return err
+	}
+	size := stat.SizeBytes
+	if size <= config.maxBytes {
+		return nil
+	}
+
+	// snapshot without locks, each item is checked again under its part lock
+	type candidate struct {
+		part     int
+		lockfile string
+		obj      Item
+	}
+	var candidates []candidate
+	for k := 0; k < 256; k++ {
+		flist, err := config.storage.ListItems(config.partPrefix(k))
+		if err != nil {
+			continue // e.g. part folder deleted by user
+		}
+		for _, lockfile := range flist {
+			buf, err := config.storage.ReadInfo(lockfile2datafile(lockfile))
+			if err != nil {
+				continue
+			}
+			obj, err := str2item(buf)
+			if err == nil && !config.inGrace(obj.age()) {
+				candidates = append(candidates, candidate{k, lockfile, obj})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].obj, candidates[j].obj
+		if config.evictPolicy == EvictLFU && a.refreshes != b.refreshes {
+			return a.refreshes < b.refreshes
+		}
+		return a.age() > b.age()
+	})
+
+	var saveError error
+	for _, c := range candidates {
+		if size <= config.maxBytes {
+			break
+		}
+		var freed int64
+		withPartLock := func() error {
+			datafile := lockfile2datafile(c.lockfile)
+			buf, err := config.storage.ReadInfo(datafile)
+			if err != nil {
+				return nil // deleted by another trim
+			}
+			obj, err := str2item(buf)
+			if err != nil || obj != c.obj {
+				return nil // found by Lookup => recently used
+			}
+			itemdir := filepath.Dir(c.lockfile)
+			_, freed = config.storage.Usage(itemdir)
+			err = config.storage.RemoveInfo(datafile)
+			if err != nil {
+				freed = 0
+				return err
+			}
+			return config.safeRemoveAll(itemdir)
+		}
+		hash := fmt.Sprintf("%02x", c.part)
+		err := config.locker.lockedfile(config.partLock(hash).lockfile, EXCLUSIVE_LOCK, withPartLock)
+		if err != nil && saveError == nil {
+			saveError = fmt.Errorf("error during evict of %s : %w", c.lockfile, err)
+		}
+		if freed > 0 {
+			size -= freed
+			report.ItemsDeleted++
+			report.ItemsEvicted++
+			report.BytesFreed += freed
+		}
+	}
+	return saveError
 }
@@ -0,0 +1,211 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// LayoutVersion is the generation of the cache layout on disk. Bump it when
+// the layout changes incompatibly: each generation has its own folder in
+// the base folder, so gorun versions with different layouts can share a
+// base folder, e.g. during an upgrade, without interfering.
+const LayoutVersion = 1
+
+// generationDir is the folder of a layout generation in base
+func generationDir(base string, layout int) string {
+	return filepath.Join(base, fmt.Sprintf("v%d", layout))
+}
+
+var reGeneration = regexp.MustCompile(`^v[0-9]+$`)
+
+// cacheFiles are the files of a cache folder besides config.lock, the
+// data folder and the by-name links
+var cacheFiles = []string{"config.json", "trim.txt", "trim.lock", "stats.json", "stats.lock", "README"}
+
+// NewGenerationConfig is like NewConfig for the generation folder of
+// LayoutVersion in base. TrimNow also removes other generations that
+// have not been used for maxAge.
+func NewGenerationConfig(base string, maxAge time.Duration) (*Config, error) {
+	return newGenerationConfig(base, maxAge, LayoutVersion)
+}
+
+func newGenerationConfig(base string, maxAge time.Duration, layout int) (*Config, error) {
+	config, err := NewConfig(generationDir(base, layout), maxAge)
+	if err != nil {
+		return nil, err
+	}
+	config.base = filepath.Clean(base)
+	return config, nil
+}
+
+// lastUsed is the newest time a cache in dir was trimmed or created:
+// TrimPeriodically refreshes trim.txt at least every refresh age while
+// the cache is used
+func (config *Config) lastUsed(dir string) (time.Time, bool) {
+	var newest time.Time
+	found := false
+	for _, name := range []string{"trim.txt", "config.json"} {
+		modTime, err := config.storage.ModTime(filepath.Join(dir, name))
+		if err == nil {
+			found = true
+			if modTime.After(newest) {
+				newest = modTime
+			}
+		}
+	}
+	return newest, found
+}
+
+// isGorunCache is true if dir has the config.json of a gorun cache, so
+// that a base folder set by mistake, e.g. to $HOME, is never removed
+func (config *Config) isGorunCache(dir string) bool {
+	buf, err := config.storage.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return false
+	}
+	m := make(map[string]string)
+	if json.Unmarshal(buf, &m) != nil {
+		return false
+	}
+	_, hasMaxAge := m["maxAge"]
+	_, hasInfo := m["#info-maxAge"]
+	return hasMaxAge && hasInfo
+}
+
+// trimGenerations removes the other generations in base, including the
+// layout from before generations, that have not been used for maxAge
+func (config *Config) trimGenerations() error {
+	if config.base == "" || !config.expires() {
+		return nil
+	}
+	entries, err := config.storage.ReadDir(config.base)
+	if err != nil {
+		return err
+	}
+	var saveError error
+	unused := func(dir string) bool {
+		t, found := config.lastUsed(dir)
+		return found && time.Since(t) > config.maxAge && config.isGorunCache(dir)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(config.base, entry.Name())
+		if !entry.IsDir() || !reGeneration.MatchString(entry.Name()) || dir == config.dir || !unused(dir) {
+			continue
+		}
+		// the global lock keeps out a gorun of that generation that
+		// starts now, until the folder is gone
+		err := config.locker.lockedfile(filepath.Join(dir, "config.lock"), EXCLUSIVE_LOCK, func() error {
+			return config.removeCache(dir)
+		})
+		if err == nil {
+			err = os.Remove(filepath.Join(dir, "config.lock"))
+		}
+		if err == nil {
+			err = config.storage.Remove(dir) // fails if the user left other files
+		}
+		if err != nil && saveError == nil {
+			saveError = fmt.Errorf("remove of cache generation %s failed - %w", dir, err)
+		}
+	}
+	if unused(config.base) {
+		err := config.locker.lockedfile(filepath.Join(config.base, "config.lock"), EXCLUSIVE_LOCK, func() error {
+			return config.removeCache(config.base)
+		})
+		if err == nil {
+			os.Remove(filepath.Join(config.base, "config.lock"))
+		}
+		if err != nil && saveError == nil {
+			saveError = fmt.Errorf("remove of old cache layout in %s failed - %w", config.base, err)
+		}
+	}
+	return saveError
+}
+
+// removeCache removes the cache in dir, except config.lock
+// - items only by safeRemoveAll, as TrimNow
+// - by-name only if links, and only the known files
+// => a folder that is not a cache keeps anything that is not named as one
+func (config *Config) removeCache(dir string) error {
+	data := filepath.Join(dir, "data")
+	parts, err := config.storage.ReadDir(data)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, part := range parts {
+		if !part.IsDir() || !config.re1.MatchString(part.Name()) {
+			continue
+		}
+		partdir := filepath.Join(data, part.Name())
+		items, err := config.storage.ReadDir(partdir)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.IsDir() && config.re2.MatchString(item.Name()) {
+				err := config.safeRemoveAll(filepath.Join(partdir, item.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, name := range []string{"lockfile", "info"} {
+			err := config.removeFile(filepath.Join(partdir, name))
+			if err != nil {
+				return err
+			}
+		}
+		err = config.removeFile(partdir)
+		if err != nil {
+			return err
+		}
+	}
+	err = config.removeFile(data)
+	if err != nil {
+		return err
+	}
+
+	byName := filepath.Join(dir, "by-name")
+	links, err := config.storage.ReadDir(byName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, link := range links {
+		if link.Type()&fs.ModeSymlink != 0 {
+			err := config.removeFile(filepath.Join(byName, link.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = config.removeFile(byName)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range cacheFiles {
+		err := config.removeFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFile removes a file or an empty folder, if it exists
+func (config *Config) removeFile(name string) error {
+	err := config.storage.Remove(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Location is a cache folder considered by DefaultConfig
+type Location struct {
+	Source   string // environment variable the folder is based on
+	Base     string // empty if Source is not usable
+	Dir      string // the generation folder in Base, see NewGenerationConfig
+	Active   bool   // true for the folder DefaultConfig uses
+	Writable bool   // folder, or the nearest existing parent, is writable
+	Reason   string // why the folder is or is not used
+}
+
+// Locations returns the cache folders DefaultConfig considers,
+// in order of precedence. The first usable folder is active.
+// GORUN_CACHE comes first, then the folders of os.UserCacheDir.
+func Locations() []Location {
+	type candidate struct {
+		source, base, subdir string
+		exact                bool // base is the cache folder, not a parent
+	}
+	var candidates []candidate
+	switch runtime.GOOS {
+	case "windows":
+		candidates = []candidate{{"LocalAppData", os.Getenv("LocalAppData"), "", false}}
+	case "darwin", "ios":
+		candidates = []candidate{{"HOME", os.Getenv("HOME"), "Library/Caches", false}}
+	case "plan9":
+		candidates = []candidate{{"home", os.Getenv("home"), "lib/cache", false}}
+	default:
+		candidates = []candidate{
+			{"XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"), "", false},
+			{"HOME", os.Getenv("HOME"), ".cache", false},
+		}
+	}
+
+	candidates = append([]candidate{{"GORUN_CACHE", os.Getenv("GORUN_CACHE"), "", true}}, candidates...)
+
+	var locations []Location
+	active := ""
+	for _, c := range candidates {
+		loc := Location{Source: c.source}
+		switch {
+		case c.base == "":
+			loc.Reason = "not set"
+		case !filepath.IsAbs(c.base) && c.exact:
+			// DefaultConfig fails rather than use another folder
+			loc.Reason = "not an absolute path, gorun fails"
+			active = c.source
+		case !filepath.IsAbs(c.base):
+			loc.Reason = "not an absolute path"
+		default:
+			loc.Base = filepath.Join(c.base, filepath.FromSlash(c.subdir), "gorun")
+			if c.exact {
+				loc.Base = filepath.Clean(c.base)
+			}
+			loc.Dir = generationDir(loc.Base, LayoutVersion)
+			loc.Writable = writable(loc.Dir)
+			if active == "" {
+				active = c.source
+				loc.Active = true
+				loc.Reason = "first usable location"
+			} else {
+				loc.Reason = "not used as " + active + " is set"
+			}
+		}
+		locations = append(locations, loc)
+	}
+	return locations
+}
+
+// writable checks dir or, if it does not exist yet, the nearest parent
+// that does as the cache folder is created on first use
+func writable(dir string) bool {
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			return access(dir, accessWrite|accessExec) == nil
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
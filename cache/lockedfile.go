@@ -6,12 +6,17 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/bir3/gocompiler/extra"
 	"github.com/bir3/gocompiler/extra/filelock"
 )
 
@@ -22,48 +27,79 @@ const (
 	EXCLUSIVE_LOCK LockType = 128
 )
 
+// updateDatafile replaces the content of datafile atomically: a temp file
+// in the same folder is written and synced, then renamed over datafile,
+// so a crash or full disk leaves either the old or the new content
 func updateDatafile(datafile string, update func(old string, writeString func(new string) error) error) error {
 
 	if !utf8.Valid([]byte(datafile)) || strings.Contains(datafile, "\x00") {
 		return fmt.Errorf("bad datafile characters: %q", datafile)
 	}
 
-	file, err := os.OpenFile(datafile, os.O_CREATE|os.O_RDWR, 0666)
+	file, err := os.OpenFile(datafile, os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
 		return fmt.Errorf("open file %q failed - %w", datafile, err)
 	}
-	writeString := func(s string) error {
-		_, err = file.Seek(0, io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("seek 0 failed for file %q - %w", datafile, err)
-		}
-		_, err := file.WriteString(s)
-		if err != nil {
-			return fmt.Errorf("WriteString failed for file %q - %w", datafile, err)
-		}
-
-		return nil
-	}
-
 	var b bytes.Buffer
 	_, err = io.Copy(&b, file)
+	// closed before rename, windows can not replace an open file
+	closeErr := file.Close()
 	if err != nil {
 		return fmt.Errorf("read file %q failed - %w", datafile, err)
 	}
-	old := b.String()
-	err = update(old, writeString)
+	if closeErr != nil {
+		return closeErr
+	}
+	writeString := func(s string) error {
+		return writeFileAtomic(datafile, s)
+	}
+	return update(b.String(), writeString)
+}
 
+func writeFileAtomic(datafile string, s string) error {
+	// random name: with Options.LockFallback writers may race
+	tmp := fmt.Sprintf("%s.%s.tmp", datafile, randomHash()[0:8])
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("create temp file for %q failed - %w", datafile, err)
+	}
+	_, err = file.WriteString(s)
+	if err != nil {
+		err = fmt.Errorf("WriteString failed for file %q - %w", tmp, err)
+	} else if err = file.Sync(); err != nil {
+		err = fmt.Errorf("sync failed for file %q - %w", tmp, err)
+	}
 	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("close failed for file %q - %w", tmp, closeErr)
+	}
+	if err == nil {
+		err = os.Rename(tmp, datafile)
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	if closeErr != nil {
-		return closeErr
-	}
+	syncDir(filepath.Dir(datafile))
 	return nil
 }
 
+// syncDir makes a rename in dir durable, best effort as not all
+// systems can sync a folder, e.g. windows
+func syncDir(dir string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	f.Sync()
+	f.Close()
+}
+
 func UpdateMultiprocess(lockfile string, lockType LockType, datafile string, updateContent func(old string, writeString func(new string) error) error) error {
+	return locker{}.updateMultiprocess(lockfile, lockType, datafile, updateContent)
+}
+
+func (l locker) updateMultiprocess(lockfile string, lockType LockType, datafile string, updateContent func(old string, writeString func(new string) error) error) error {
 	// easier to understand api if lock type is explicit even if only one value allowed
 	if lockType != EXCLUSIVE_LOCK {
 		return fmt.Errorf("must specify ExclusiveLock")
@@ -71,10 +107,32 @@ func UpdateMultiprocess(lockfile string, lockType LockType, datafile string, upd
 	f2 := func() error {
 		return updateDatafile(datafile, updateContent)
 	}
-	return Lockedfile(lockfile, EXCLUSIVE_LOCK, f2)
+	return l.lockedfile(lockfile, EXCLUSIVE_LOCK, f2)
 }
 
+// ErrWaitTimeout is returned when a lock is not taken within the wait time
+var ErrWaitTimeout = errors.New("timeout waiting for lock")
+
 func Lockedfile(lockfile string, lockType LockType, f func() error) error {
+	return locker{}.lockedfile(lockfile, lockType, f)
+}
+
+// locker takes the file locks of a Config. The zero value is strict:
+// a lock that fails is an error.
+type locker struct {
+	lock     func(file *os.File, lockType LockType) error // nil = filelock, injectable by tests
+	fallback bool                                         // a lock that fails only warns, see Options.LockFallback
+	warn     func(lockfile string, err error)             // called for a lock that fails with fallback
+}
+
+func (l locker) lockedfile(lockfile string, lockType LockType, f func() error) error {
+	return l.lockedfileWait(context.Background(), lockfile, lockType, 0, nil, f)
+}
+
+// lockedfileWait is like Lockedfile but if the exclusive lock is held by
+// another and wait is not zero or ctx can be cancelled, calls waiting once
+// and fails with ErrWaitTimeout after wait or with the error of ctx
+func (l locker) lockedfileWait(ctx context.Context, lockfile string, lockType LockType, wait time.Duration, waiting func(), f func() error) error {
 
 	if !utf8.Valid([]byte(lockfile)) || strings.Contains(lockfile, "\x00") {
 		return fmt.Errorf("bad lockfile characters: %q", lockfile)
@@ -83,22 +141,45 @@ func Lockedfile(lockfile string, lockType LockType, f func() error) error {
 	// complete before lock is released (as opposed to storing the data in the lockfile)
 
 	file, err := os.OpenFile(lockfile, os.O_CREATE|os.O_RDWR, 0666)
+	if errors.Is(err, os.ErrNotExist) {
+		// lockfiles are always local: their folder is missing if a
+		// Storage keeps the items elsewhere, see MemStorage
+		err = extra.MkdirAllRace(filepath.Dir(lockfile), dirPerm())
+		if err == nil {
+			file, err = os.OpenFile(lockfile, os.O_CREATE|os.O_RDWR, 0666)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to open/create file %s - %w", lockfile, err)
 	}
-	if lockType == SHARED_LOCK {
+	if l.lock != nil {
+		err = l.lock(file, lockType)
+	} else if lockType == SHARED_LOCK {
 		err = filelock.RLock(file)
+	} else if wait > 0 || ctx.Done() != nil {
+		err = lockWait(ctx, file, wait, waiting)
 	} else {
 		err = filelock.Lock(file)
 	}
 
+	locked := err == nil
+	// a timeout or cancel is not a lock that is unavailable
+	if err != nil && l.fallback && !errors.Is(err, ErrWaitTimeout) && ctx.Err() == nil {
+		if l.warn != nil {
+			l.warn(lockfile, err)
+		}
+		err = nil
+	}
 	if err != nil {
 		file.Close()
 		return fmt.Errorf("failed to lock file %s - %w", lockfile, err)
 	}
 	errorOut := f()
 
-	errUnlock := filelock.Unlock(file)
+	var errUnlock error
+	if locked {
+		errUnlock = filelock.Unlock(file)
+	}
 	errClose := file.Close()
 
 	if errorOut == nil && errUnlock != nil {
@@ -111,3 +192,29 @@ func Lockedfile(lockfile string, lockType LockType, f func() error) error {
 
 	return errorOut
 }
+
+// lockWait polls for the exclusive lock, wait zero = no time limit
+func lockWait(ctx context.Context, file *os.File, wait time.Duration, waiting func()) error {
+	deadline := time.Now().Add(wait)
+	for notified := false; ; notified = true {
+		locked, err := tryLock(file)
+		if errors.Is(err, errors.ErrUnsupported) {
+			// no polling => ctx is not honored while blocked
+			return filelock.Lock(file)
+		}
+		if err != nil || locked {
+			return err
+		}
+		if !notified && waiting != nil {
+			waiting()
+		}
+		if wait > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("waited %s - %w", wait, ErrWaitTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("lock wait aborted - %w", ctx.Err())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStorage is a Storage in memory, e.g. for fast tests of the cache
+// logic. The objdir given to create exists only in memory, so create
+// must not write to it. Lockfiles and their folders stay on the local
+// disk, and the items are not shared with other processes.
+type MemStorage struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode // by clean path
+}
+
+type memNode struct {
+	dir     bool
+	target  string // symlink if not ""
+	buf     []byte
+	modTime time.Time
+}
+
+// NewMemStorage returns an empty MemStorage
+func NewMemStorage() *MemStorage {
+	return &MemStorage{nodes: make(map[string]*memNode)}
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+// children returns the clean paths in dir, sorted, with mu held
+func (m *MemStorage) children(dir string) []string {
+	var paths []string
+	for path := range m.nodes {
+		if filepath.Dir(path) == dir && path != dir {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (m *MemStorage) MkdirAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		node, found := m.nodes[dir]
+		if found && !node.dir {
+			return fmt.Errorf("mkdir %s: not a folder", dir)
+		}
+		if !found {
+			m.nodes[dir] = &memNode{dir: true, modTime: time.Now()}
+		}
+		if filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+func (m *MemStorage) Mkdir(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if _, found := m.nodes[dir]; found {
+		return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+	}
+	m.nodes[dir] = &memNode{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemStorage) RemoveAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	for path := range m.nodes {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(m.nodes, path)
+		}
+	}
+	return nil
+}
+
+// Exists follows a symlink, as FileStorage
+func (m *MemStorage) Exists(dir string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	node, found := m.nodes[dir]
+	if found && node.target != "" {
+		_, found = m.nodes[filepath.Join(filepath.Dir(dir), node.target)]
+	}
+	return found, nil
+}
+
+func (m *MemStorage) ReadInfo(datafile string) (string, error) {
+	buf, err := m.ReadFile(datafile)
+	return string(buf), err
+}
+
+// UpdateInfo does not hold the storage while update runs, as update
+// creates the objdir. The lock of the datafile serializes the updates.
+func (m *MemStorage) UpdateInfo(datafile string, update func(old string, writeString func(new string) error) error) error {
+	old, err := m.ReadInfo(datafile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return update(old, func(new string) error {
+		return m.WriteFile(datafile, []byte(new))
+	})
+}
+
+func (m *MemStorage) RemoveInfo(datafile string) error {
+	return m.Remove(datafile)
+}
+
+func (m *MemStorage) ListItems(partDir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	partDir = filepath.Clean(partDir)
+	if _, found := m.nodes[partDir]; !found {
+		return nil, notExist("open", partDir)
+	}
+	var flist []string
+	for _, path := range m.children(partDir) {
+		if m.nodes[path].dir {
+			flist = append(flist, filepath.Join(path, "lockfile"))
+		}
+	}
+	return flist, nil
+}
+
+func (m *MemStorage) ModTime(path string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[filepath.Clean(path)]
+	if !found {
+		return time.Time{}, notExist("stat", path)
+	}
+	return node.modTime, nil
+}
+
+func (m *MemStorage) Usage(dir string) (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	count, size := 0, int64(0)
+	for path, node := range m.nodes {
+		if !node.dir && strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			size += int64(len(node.buf))
+			count++
+		}
+	}
+	return count, size
+}
+
+func (m *MemStorage) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, found := m.nodes[filepath.Clean(path)]
+	if !found || node.dir || node.target != "" {
+		return nil, notExist("open", path)
+	}
+	return append([]byte(nil), node.buf...), nil
+}
+
+func (m *MemStorage) WriteFile(path string, buf []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if node, found := m.nodes[path]; found && node.dir {
+		return fmt.Errorf("write %s: is a folder", path)
+	}
+	m.nodes[path] = &memNode{buf: append([]byte(nil), buf...), modTime: time.Now()}
+	return nil
+}
+
+func (m *MemStorage) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	node, found := m.nodes[path]
+	if !found {
+		return notExist("remove", path)
+	}
+	if node.dir && len(m.children(path)) > 0 {
+		return fmt.Errorf("remove %s: folder not empty", path)
+	}
+	delete(m.nodes, path)
+	return nil
+}
+
+func (m *MemStorage) ReadDir(dir string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if node, found := m.nodes[dir]; !found || !node.dir {
+		return nil, notExist("open", dir)
+	}
+	var entries []fs.DirEntry
+	for _, path := range m.children(dir) {
+		entries = append(entries, fs.FileInfoToDirEntry(memInfo{filepath.Base(path), *m.nodes[path]}))
+	}
+	return entries, nil
+}
+
+func (m *MemStorage) Symlink(target, link string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[filepath.Clean(link)] = &memNode{target: target, modTime: time.Now()}
+	return nil
+}
+
+// memInfo is the fs.FileInfo of a memNode
+type memInfo struct {
+	name string
+	node memNode
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.node.buf)) }
+func (i memInfo) ModTime() time.Time { return i.node.modTime }
+func (i memInfo) IsDir() bool        { return i.node.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (i memInfo) Mode() fs.FileMode {
+	switch {
+	case i.node.dir:
+		return fs.ModeDir | 0755
+	case i.node.target != "":
+		return fs.ModeSymlink | 0777
+	}
+	return 0644
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are the lookups of the current process, as opposed to
+// Counters that are shared by all processes using the cache
+type Metrics struct {
+	Time     time.Time
+	Hits     int64 // lookups that found an item
+	Misses   int64 // lookups that called create
+	Compiles int64 // create calls that succeeded
+}
+
+type metrics struct {
+	hits, misses, compiles atomic.Int64
+}
+
+// Metrics returns the lookups of the current process so far
+func (config *Config) Metrics() Metrics {
+	return Metrics{
+		Time:     time.Now(),
+		Hits:     config.metrics.hits.Load(),
+		Misses:   config.metrics.misses.Load(),
+		Compiles: config.metrics.compiles.Load(),
+	}
+}
+
+// WriteMetrics writes Metrics as a JSON line to w every interval
+// until Close is called, e.g. for a long-running process.
+// Write errors are ignored.
+func (config *Config) WriteMetrics(w io.Writer, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("metrics interval must be positive")
+	}
+	config.metricsMutex.Lock()
+	defer config.metricsMutex.Unlock()
+	if config.closed {
+		return fmt.Errorf("config is closed")
+	}
+	if config.metricsStop != nil {
+		return fmt.Errorf("metrics writer already started")
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	config.metricsStop, config.metricsDone = stop, done
+
+	go func() {
+		defer close(done)
+		enc := json.NewEncoder(w)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				enc.Encode(config.Metrics())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stopMetrics stops WriteMetrics, if started
+func (config *Config) stopMetrics() {
+	config.metricsMutex.Lock()
+	defer config.metricsMutex.Unlock()
+	if config.metricsStop != nil {
+		close(config.metricsStop)
+		<-config.metricsDone
+		config.metricsStop, config.metricsDone = nil, nil
+	}
+}
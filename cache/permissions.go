@@ -0,0 +1,88 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// PermissionIssue is a cache entry the current user can not use or delete
+type PermissionIssue struct {
+	Path    string
+	Problem string
+}
+
+const (
+	accessRead  = 4
+	accessWrite = 2
+	accessExec  = 1
+)
+
+// CheckPermissions reports cache entries that the current user can not
+// read or delete, e.g. entries created by another user on a shared host.
+// Trim will silently skip such entries.
+func (config *Config) CheckPermissions() ([]PermissionIssue, error) {
+	return config.checkPermissions(false)
+}
+
+// FixPermissions is like CheckPermissions but first tries to add the
+// missing user permissions to entries owned by the current user.
+// Returns the issues that remain.
+func (config *Config) FixPermissions() ([]PermissionIssue, error) {
+	return config.checkPermissions(true)
+}
+
+func (config *Config) checkPermissions(fix bool) ([]PermissionIssue, error) {
+	var issues []PermissionIssue
+
+	check := func(path string, d fs.DirEntry) {
+		var mode uint32
+		var problem string
+		switch {
+		case d.IsDir():
+			// must list and remove content
+			mode, problem = accessRead|accessWrite|accessExec, "directory not readable or writable"
+		case d.Name() == "lockfile" || d.Name() == "info":
+			mode, problem = accessRead|accessWrite, "file not readable or writable"
+		default:
+			return // deleted via parent directory
+		}
+		if access(path, mode) == nil {
+			return
+		}
+		if fix {
+			info, err := os.Lstat(path)
+			if err == nil && ownedByUser(info) {
+				perm := info.Mode().Perm() | fs.FileMode(mode<<6) // user bits
+				if os.Chmod(path, perm) == nil && access(path, mode) == nil {
+					return
+				}
+			}
+		}
+		issues = append(issues, PermissionIssue{path, problem})
+	}
+
+	for part := 0; part < 256; part++ {
+		dir := config.partPrefix(part)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue // missing part => nothing to delete
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue // part lockfile
+			}
+			filepath.WalkDir(filepath.Join(dir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+				if err == nil {
+					check(path, d)
+				}
+				return nil // unreadable dir is already reported => skip
+			})
+		}
+	}
+	return issues, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckExec returns an error if exefile in the cache could have been
+// replaced by another user, e.g. when root runs from a cache folder
+// that another user can write to. Checks exefile and its folders up to
+// and including the cache folder, or its base folder, see
+// NewGenerationConfig.
+func (config *Config) CheckExec(exefile string) error {
+	exefile = filepath.Clean(exefile)
+	if !strings.HasPrefix(exefile, config.dir+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not in cache %s", exefile, config.dir)
+	}
+	top := config.dir
+	if config.base != "" {
+		top = config.base // a generation folder can be replaced from base
+	}
+	euid := os.Geteuid()
+	for path := exefile; ; path = filepath.Dir(path) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if owner, ok := fileOwner(info); ok {
+			if reason := unsafeReason(info.Mode(), owner, euid); reason != "" {
+				return fmt.Errorf("unsafe cache: %s %s", path, reason)
+			}
+		}
+		if path == top {
+			return nil
+		}
+	}
+}
+
+// unsafeReason returns why a file with mode and owner is unsafe
+// to execute for user euid, or "" if safe
+func unsafeReason(mode fs.FileMode, owner, euid int) string {
+	switch {
+	case euid == 0 && owner != 0:
+		return fmt.Sprintf("is owned by uid %d, not root", owner)
+	case euid == 0 && mode.Perm()&0022 != 0:
+		return "is writable by group or others"
+	case owner != euid && mode.Perm()&0002 != 0:
+		return fmt.Sprintf("is world-writable and owned by uid %d", owner)
+	}
+	return ""
+}
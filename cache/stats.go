@@ -0,0 +1,78 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Counters is the long-term activity of a cache
+type Counters struct {
+	Compiles  int
+	Evictions int
+	Since     time.Time // creation or last reset
+}
+
+func (config *Config) statsLock() Lockpair {
+	return NewLockPair(config.dir, "stats.lock", "stats.json")
+}
+
+// updateStats applies f to the persisted counters under an exclusive lock
+func (config *Config) updateStats(f func(counters *Counters)) error {
+	updateContent := func(old string, writeString func(new string) error) error {
+		counters := parseCounters(old)
+		f(&counters)
+		m := make(map[string]string)
+		m["compiles"] = strconv.Itoa(counters.Compiles)
+		m["evictions"] = strconv.Itoa(counters.Evictions)
+		m["since"] = counters.Since.Format(time.RFC3339)
+		final, err := jsonString(m)
+		if err != nil {
+			return err
+		}
+		return writeString(final)
+	}
+	pair := config.statsLock()
+	return config.updateFile(pair, updateContent)
+}
+
+// parseCounters never fails: unknown content restarts the counters
+func parseCounters(s string) Counters {
+	m := make(map[string]string)
+	json.Unmarshal([]byte(s), &m)
+	counters := Counters{}
+	counters.Compiles, _ = strconv.Atoi(m["compiles"])
+	counters.Evictions, _ = strconv.Atoi(m["evictions"])
+	since, err := time.Parse(time.RFC3339, m["since"])
+	if err != nil {
+		since = time.Now()
+	}
+	counters.Since = since
+	return counters
+}
+
+// AddStats adds to the persisted compile and eviction counters
+func (config *Config) AddStats(compiles, evictions int) error {
+	return config.updateStats(func(counters *Counters) {
+		counters.Compiles += compiles
+		counters.Evictions += evictions
+	})
+}
+
+func (config *Config) GetStats() (Counters, error) {
+	var out Counters
+	err := config.updateStats(func(counters *Counters) {
+		out = *counters
+	})
+	return out, err
+}
+
+func (config *Config) ResetStats() error {
+	return config.updateStats(func(counters *Counters) {
+		*counters = Counters{Since: time.Now()}
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bir3/gocompiler/extra"
+)
+
+// Storage holds the items and the other files of a cache. FileStorage,
+// the default, uses the local filesystem. Locks are not part of Storage,
+// see Lockedfile: lockfiles and their folders are always on the local
+// disk. The objdir given to create is a local folder with FileStorage as
+// the go toolchain writes to it.
+type Storage interface {
+	// MkdirAll creates dir and any missing parents, safe for concurrent use
+	MkdirAll(dir string) error
+
+	// Mkdir creates dir and fails with fs.ErrExist if it exists
+	Mkdir(dir string) error
+
+	// RemoveAll removes dir and everything in it
+	RemoveAll(dir string) error
+
+	// Exists is true if dir exists
+	Exists(dir string) (bool, error)
+
+	// ReadInfo returns the content of an info datafile
+	ReadInfo(datafile string) (string, error)
+
+	// UpdateInfo calls update with the content of an info datafile,
+	// empty if new, and a function to replace the content
+	UpdateInfo(datafile string, update func(old string, writeString func(new string) error) error) error
+
+	// RemoveInfo removes an info datafile
+	RemoveInfo(datafile string) error
+
+	// ListItems returns the item lockfiles of a part folder, sorted
+	ListItems(partDir string) ([]string, error)
+
+	// ModTime returns the modification time of a file or folder
+	ModTime(path string) (time.Time, error)
+
+	// Usage returns the number of files below dir and their total size,
+	// called concurrently for different parts by GetInfo
+	Usage(dir string) (count int, size int64)
+
+	// ReadFile returns the content of a file, e.g. config.json
+	ReadFile(path string) ([]byte, error)
+
+	// WriteFile replaces the content of a file, not atomically, e.g. the
+	// owner record of a lockfile
+	WriteFile(path string, buf []byte) error
+
+	// Remove removes a file, a symlink or an empty folder
+	Remove(path string) error
+
+	// ReadDir returns the entries of dir, sorted by name
+	ReadDir(dir string) ([]fs.DirEntry, error)
+
+	// Symlink replaces link atomically with a symlink to target,
+	// relative to the folder of link
+	Symlink(target, link string) error
+}
+
+// FileStorage is a Storage on the local filesystem
+type FileStorage struct{}
+
+func (FileStorage) MkdirAll(dir string) error {
+	return extra.MkdirAllRace(dir, dirPerm())
+}
+
+func (FileStorage) Mkdir(dir string) error {
+	return os.Mkdir(dir, dirPerm())
+}
+
+func (FileStorage) RemoveAll(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+func (FileStorage) Exists(dir string) (bool, error) {
+	_, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (FileStorage) ReadInfo(datafile string) (string, error) {
+	buf, err := os.ReadFile(datafile)
+	return string(buf), err
+}
+
+func (FileStorage) UpdateInfo(datafile string, update func(old string, writeString func(new string) error) error) error {
+	return updateDatafile(datafile, update)
+}
+
+func (FileStorage) RemoveInfo(datafile string) error {
+	return os.Remove(datafile)
+}
+
+// ListItems reads partDir once and stats <item>/lockfile, same result
+// as filepath.Glob(partDir/*/lockfile) but faster
+func (FileStorage) ListItems(partDir string) ([]string, error) {
+	entries, err := os.ReadDir(partDir)
+	if err != nil {
+		return nil, err
+	}
+	var flist []string
+	for _, entry := range entries {
+		lockfile := filepath.Join(partDir, entry.Name(), "lockfile")
+		if _, err := os.Lstat(lockfile); err == nil {
+			flist = append(flist, lockfile)
+		}
+	}
+	return flist, nil
+}
+
+func (FileStorage) ModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (FileStorage) Usage(dir string) (int, int64) {
+	count, size := 0, int64(0)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+				count++
+			}
+		}
+		return nil
+	})
+	return count, size
+}
+
+func (FileStorage) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (FileStorage) WriteFile(path string, buf []byte) error {
+	return os.WriteFile(path, buf, 0666)
+}
+
+func (FileStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (FileStorage) ReadDir(dir string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+// Symlink creates a link with a unique name and renames it to link:
+// a concurrent Symlink of the same link never sees a missing link
+func (FileStorage) Symlink(target, link string) error {
+	tmp := filepath.Join(filepath.Dir(link), ".tmp-"+randomHash()[:16])
+	err := os.Symlink(target, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, link)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
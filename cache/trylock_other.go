@@ -0,0 +1,17 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd)
+
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// no non-blocking lock here => callers fall back to a blocking lock
+func tryLock(file *os.File) (bool, error) {
+	return false, errors.ErrUnsupported
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// exeNames are the executables that gorun writes to an objdir,
+// see gorun.RunInfo.ExeName
+var exeNames = []string{"main", "main.wasm"}
+
+// VerifyReport describes the work done by Verify and Repair
+type VerifyReport struct {
+	ItemsScanned int
+	ItemsDeleted int // only by Repair
+	Broken       []BrokenItem
+}
+
+// BrokenItem is an item that Lookup would return without a usable executable
+type BrokenItem struct {
+	Itemdir string
+	Problem string
+}
+
+// Verify reports items whose info can not be parsed or whose objdir is
+// missing or has no non-empty executable, e.g. after a full disk.
+// Items being created are skipped.
+func (config *Config) Verify() (VerifyReport, error) {
+	return config.verify(false)
+}
+
+// Repair is like Verify but also deletes the broken items, so the next
+// Lookup creates them again
+func (config *Config) Repair() (VerifyReport, error) {
+	return config.verify(true)
+}
+
+func (config *Config) verify(repair bool) (VerifyReport, error) {
+	var report VerifyReport
+	var saveError error
+	for part := 0; part < 256; part++ {
+		err := config.verifyPart(part, repair, &report)
+		if err != nil && saveError == nil {
+			saveError = err
+		}
+	}
+	return report, saveError
+}
+
+func (config *Config) verifyPart(part int, repair bool, report *VerifyReport) error {
+	exists, err := config.storage.Exists(config.partPrefix(part))
+	if err == nil && !exists {
+		return nil // part folder deleted by user
+	}
+	withPartLock := func() error {
+		flist, err := config.storage.ListItems(config.partPrefix(part))
+		if err != nil {
+			return fmt.Errorf("list lockfiles failed - %w", err)
+		}
+		var saveError error
+		for _, lockfile := range flist {
+			report.ItemsScanned++
+			itemdir := filepath.Dir(lockfile)
+			datafile := lockfile2datafile(lockfile)
+			buf, err := config.storage.ReadInfo(datafile)
+			if errors.Is(err, os.ErrNotExist) {
+				continue // being created, or an orphan for TrimNow
+			}
+			problem := ""
+			if err != nil {
+				problem = fmt.Sprintf("read info failed - %s", err)
+			} else {
+				problem = config.checkItem(itemdir, buf)
+			}
+			if problem == "" {
+				continue
+			}
+			report.Broken = append(report.Broken, BrokenItem{itemdir, problem})
+			if !repair {
+				continue
+			}
+			// exclusive part lock => no Lookup holds the item
+			err = config.safeRemoveAll2(datafile, itemdir)
+			if err != nil {
+				saveError = fmt.Errorf("repair of %s failed - %w", itemdir, err)
+				continue
+			}
+			report.ItemsDeleted++
+		}
+		return saveError
+	}
+	lockType := SHARED_LOCK
+	if repair {
+		lockType = EXCLUSIVE_LOCK
+	}
+	hash := fmt.Sprintf("%02x", part)
+	return config.locker.lockedfile(config.partLock(hash).lockfile, lockType, withPartLock)
+}
+
+// checkItem returns the problem of the item in itemdir with info, or ""
+func (config *Config) checkItem(itemdir string, info string) string {
+	obj, err := str2item(info)
+	if err != nil {
+		return fmt.Sprintf("bad info - %s", err)
+	}
+	// only objdirs of the cache layout, never follow info elsewhere
+	if filepath.Dir(obj.objdir) != itemdir {
+		return fmt.Sprintf("objdir %s is not in the item folder", obj.objdir)
+	}
+	exists, err := config.storage.Exists(obj.objdir)
+	if err != nil || !exists {
+		return fmt.Sprintf("objdir %s is missing", obj.objdir)
+	}
+	for _, name := range exeNames {
+		fileinfo, err := os.Lstat(filepath.Join(obj.objdir, name))
+		if err == nil && fileinfo.Mode().IsRegular() && fileinfo.Size() > 0 {
+			return ""
+		}
+	}
+	return fmt.Sprintf("objdir %s has no executable", obj.objdir)
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"os"
+	"strings"
+
+	"github.com/bir3/gorun/cache"
+)
+
+// CapturedEnv records what enters the cache key of a compile, so the
+// compile can be repeated on another machine with Replay, e.g. for
+// "it compiles here but not there" reports
+type CapturedEnv struct {
+	Source         string
+	Files          map[string]string `json:",omitempty"`
+	Input          string            // input of CompileStringInfo
+	BuildFlags     []string          `json:",omitempty"`
+	Toolchain      string            `json:",omitempty"`
+	SourcePath     string            `json:",omitempty"`
+	GOOS           string            `json:",omitempty"`
+	GOARCH         string            `json:",omitempty"`
+	Debug          bool
+	Vet            bool
+	HashOnlySource bool
+	Env            map[string]string // environment variables of the cache key
+	CacheInput     string            // complete cache input on the capturing machine
+	Error          string            // compile error, empty if the compile succeeded
+}
+
+// NewCapturedEnv captures the cache key of compiling goCode with info
+// and input, see CompileStringInfo. Error is left for the caller.
+func NewCapturedEnv(info *RunInfo, goCode string, input string) (*CapturedEnv, error) {
+	embeds, err := readEmbeds(info, goCode)
+	if err != nil {
+		return nil, err
+	}
+	cacheInput, err := cacheInput(info, goCode, embeds, input, cacheKeyEpoch)
+	if err != nil {
+		return nil, err
+	}
+	return &CapturedEnv{
+		Source:         goCode,
+		Files:          info.Files,
+		Input:          input,
+		BuildFlags:     info.BuildFlags,
+		Toolchain:      info.Toolchain,
+		SourcePath:     info.SourcePath,
+		GOOS:           info.GOOS,
+		GOARCH:         info.GOARCH,
+		Debug:          info.Debug,
+		Vet:            info.Vet,
+		HashOnlySource: info.HashOnlySource,
+		Env:            map[string]string{"CGO_ENABLED": os.Getenv("CGO_ENABLED")},
+		CacheInput:     cacheInput,
+	}, nil
+}
+
+// RunInfo returns the captured settings
+func (env *CapturedEnv) RunInfo() *RunInfo {
+	return &RunInfo{
+		BuildFlags:     env.BuildFlags,
+		Files:          env.Files,
+		Toolchain:      env.Toolchain,
+		SourcePath:     env.SourcePath,
+		GOOS:           env.GOOS,
+		GOARCH:         env.GOARCH,
+		Debug:          env.Debug,
+		Vet:            env.Vet,
+		HashOnlySource: env.HashOnlySource,
+	}
+}
+
+// Replay compiles the captured script with an empty, temporary cache.
+// diff has the lines of the cache input that differ on this machine,
+// "-" for captured and "+" for here, e.g. other versions; Env is not
+// applied, the caller must set it for an identical cache input.
+// compileErr is the result of the compile.
+func Replay(env *CapturedEnv) (diff []string, compileErr error, err error) {
+	info := env.RunInfo()
+	embeds, err := readEmbeds(info, env.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	here, err := cacheInput(info, env.Source, embeds, env.Input, cacheKeyEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	diff = diffLines(env.CacheInput, here)
+
+	dir, err := os.MkdirTemp("", "gorun-replay")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	c, err := cache.NewConfig(dir, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, compileErr = CompileStringInfo(c, info, env.Source, nil, env.Input)
+	return diff, compileErr, nil
+}
+
+// diffLines returns the lines only in a, prefixed "- ", and the lines
+// only in b, prefixed "+ "
+func diffLines(a, b string) []string {
+	count := make(map[string]int)
+	for _, line := range strings.Split(b, "\n") {
+		count[line]++
+	}
+	var diff []string
+	for _, line := range strings.Split(a, "\n") {
+		if count[line] > 0 {
+			count[line]--
+		} else {
+			diff = append(diff, "- "+line)
+		}
+	}
+	for _, line := range strings.Split(b, "\n") {
+		if count[line] > 0 {
+			count[line]--
+			diff = append(diff, "+ "+line)
+		}
+	}
+	return diff
+}
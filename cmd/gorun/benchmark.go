@@ -0,0 +1,51 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bir3/gorun"
+)
+
+// benchmark runs the program in outdir n times as a child process and
+// shows the wall time per run; the output of the program is discarded,
+// except stderr
+func benchmark(outdir string, s string, args []string, n int) error {
+	exefile := filepath.Join(outdir, "main")
+	d, _ := gorun.ParseDirectives(s) // already validated by compile
+	var durations []time.Duration
+	for i := 0; i < n; i++ {
+		cmd := exec.Command(exefile, append(d.Args, args...)...)
+		cmd.Env = d.Environ(os.Environ())
+		cmd.Stderr = os.Stderr
+		start := time.Now()
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("run %d of %d failed - %w", i+1, n, err)
+		}
+		durations = append(durations, time.Since(start))
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	var total time.Duration
+	for _, dt := range durations {
+		total += dt
+	}
+	median := durations[n/2]
+	if n%2 == 0 {
+		median = (durations[n/2-1] + durations[n/2]) / 2
+	}
+	fmt.Printf("%d runs: min %s, median %s, max %s, total %s\n", n,
+		durations[0].Round(time.Microsecond), median.Round(time.Microsecond),
+		durations[n-1].Round(time.Microsecond), total.Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+
+	"github.com/bir3/gorun"
+	"github.com/bir3/gorun/cache"
+)
+
+// a bundle is a zip file with manifest.json and one executable per
+// script named by its sha256, e.g. bin/<sha256>
+
+const bundleManifestName = "manifest.json"
+
+type bundleManifest struct {
+	GOOS    string
+	GOARCH  string
+	Scripts []bundleEntry
+}
+
+type bundleEntry struct {
+	Script string   // path as given to -bundle, with forward slashes
+	Hash   string   // sha256 of the script source
+	Binary string   // name of the executable in the bundle
+	Args   []string // from gorun:args and gorun:env directives
+	Env    []string
+}
+
+var bundleBinaryRe = regexp.MustCompile(`^bin/[0-9a-f]{64}$`)
+
+func sha256Hex(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// bundle compiles scripts and writes their executables to out
+func bundle(out string, scripts []string) {
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+	manifest := bundleManifest{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	binaries := make(map[string]string) // name in bundle => file
+	for _, script := range scripts {
+		filename, err := filepath.Abs(script)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		s := readFileAndStrip(filename)
+		d, err := gorun.ParseDirectives(s)
+		if err != nil {
+			errExit(fmt.Sprintf("%s: %s", script, err))
+		}
+		outdir, err := gorun.CompileStringInfo(c, &gorun.RunInfo{ScriptDir: filepath.Dir(filename)}, s, nil, scriptInput())
+		if err != nil {
+			errExitCode(compileExitCode(err), fmt.Sprintf("%s: %s", script, err))
+		}
+		exefile := filepath.Join(outdir, "main")
+		buf, err := os.ReadFile(exefile)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		entry := bundleEntry{
+			Script: filepath.ToSlash(filepath.Clean(script)),
+			Hash:   sha256Hex([]byte(s)),
+			Binary: "bin/" + sha256Hex(buf),
+			Args:   d.Args,
+			Env:    d.Env,
+		}
+		manifest.Scripts = append(manifest.Scripts, entry)
+		binaries[entry.Binary] = exefile
+	}
+
+	err = writeBundle(out, manifest, binaries)
+	if err != nil {
+		os.Remove(out)
+		errExit(fmt.Sprintf("%s", err))
+	}
+	fmt.Printf("bundled %d scripts in %s\n", len(scripts), out)
+}
+
+func writeBundle(out string, manifest bundleManifest, binaries map[string]string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := zw.Create(bundleManifestName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		return err
+	}
+	for name, exefile := range binaries {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		exe, err := os.Open(exefile)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, exe)
+		exe.Close()
+		if err != nil {
+			return fmt.Errorf("failed to add %s - %w", exefile, err)
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// findBundleEntry returns the entry for script: same path or,
+// if not found, the only entry with the same file name
+func findBundleEntry(manifest bundleManifest, script string) (bundleEntry, error) {
+	script = filepath.ToSlash(filepath.Clean(script))
+	var matches []bundleEntry
+	for _, entry := range manifest.Scripts {
+		if entry.Script == script {
+			return entry, nil
+		}
+		if path.Base(entry.Script) == path.Base(script) {
+			matches = append(matches, entry)
+		}
+	}
+	if len(matches) != 1 {
+		return bundleEntry{}, fmt.Errorf("script %s not found in bundle", script)
+	}
+	return matches[0], nil
+}
+
+// readBundle extracts the executable for script from bundleFile
+// into the cache and returns its path
+func readBundle(c *cache.Config, bundleFile string, script string) (string, bundleEntry, error) {
+	zr, err := zip.OpenReader(bundleFile)
+	if err != nil {
+		return "", bundleEntry{}, err
+	}
+	defer zr.Close()
+
+	readEntry := func(name string) ([]byte, error) {
+		f, err := zr.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("bad bundle %s - %w", bundleFile, err)
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	buf, err := readEntry(bundleManifestName)
+	if err != nil {
+		return "", bundleEntry{}, err
+	}
+	var manifest bundleManifest
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return "", bundleEntry{}, fmt.Errorf("bad bundle manifest - %w", err)
+	}
+	if manifest.GOOS != runtime.GOOS || manifest.GOARCH != runtime.GOARCH {
+		return "", bundleEntry{}, fmt.Errorf("bundle is for %s/%s, not %s/%s", manifest.GOOS, manifest.GOARCH, runtime.GOOS, runtime.GOARCH)
+	}
+	entry, err := findBundleEntry(manifest, script)
+	if err != nil {
+		return "", bundleEntry{}, err
+	}
+	// the binary name is used for a cache key and a zip entry name only,
+	// but must never be a path outside the bundle
+	if !bundleBinaryRe.MatchString(entry.Binary) {
+		return "", bundleEntry{}, fmt.Errorf("bad binary name %q in bundle", entry.Binary)
+	}
+
+	outdir, err := c.Lookup("// gorun bundle\n"+entry.Binary, func(outdir string) error {
+		buf, err := readEntry(entry.Binary)
+		if err != nil {
+			return err
+		}
+		if "bin/"+sha256Hex(buf) != entry.Binary {
+			return fmt.Errorf("bundle binary %s is corrupt", entry.Binary)
+		}
+		return os.WriteFile(filepath.Join(outdir, "main"), buf, 0777)
+	})
+	if err != nil {
+		return "", bundleEntry{}, err
+	}
+	return filepath.Join(outdir, "main"), entry, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bir3/gorun"
+)
+
+// captureEnv writes the cache key of a compile with its result compileErr
+// to filename
+func captureEnv(filename string, info *gorun.RunInfo, s string, input string, compileErr error) error {
+	env, err := gorun.NewCapturedEnv(info, s, input)
+	if err != nil {
+		return err
+	}
+	if compileErr != nil {
+		env.Error = compileErr.Error()
+	}
+	buf, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filename, append(buf, '\n'), 0666)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "captured compile environment in %s\n", filename)
+	return nil
+}
+
+// replayEnv repeats a compile captured by captureEnv and is true if the
+// result is the same: both succeed or both fail
+func replayEnv(filename string) bool {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	var env gorun.CapturedEnv
+	err = json.Unmarshal(buf, &env)
+	if err != nil {
+		errExit(fmt.Sprintf("bad capture %s - %s", filename, err))
+	}
+	for k, v := range env.Env {
+		os.Setenv(k, v)
+	}
+	diff, compileErr, err := gorun.Replay(&env)
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	if len(diff) == 0 {
+		fmt.Printf("cache input is identical\n")
+	} else {
+		fmt.Printf("cache input differs, - captured, + here:\n")
+		for _, line := range diff {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	captured := "compile succeeded"
+	if env.Error != "" {
+		captured = "compile failed"
+	}
+	here := "compile succeeded"
+	if compileErr != nil {
+		here = "compile failed"
+		fmt.Printf("%s\n", compileErr)
+	}
+	reproduced := (compileErr != nil) == (env.Error != "")
+	fmt.Printf("captured: %s, here: %s, reproduced: %v\n", captured, here, reproduced)
+	return reproduced
+}
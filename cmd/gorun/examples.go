@@ -0,0 +1,56 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// example scripts built into gorun to verify an installation
+// - named .gorun as go build ./... must not compile them
+
+//go:embed examples/*.gorun
+var examplesFS embed.FS
+
+// exampleNames returns the names of the examples, sorted
+func exampleNames() []string {
+	files, _ := fs.Glob(examplesFS, "examples/*.gorun") // only bad pattern errors
+	var names []string
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(path.Base(file), ".gorun"))
+	}
+	return names
+}
+
+// exampleSource returns the source of example name without shebang line
+func exampleSource(name string) (string, error) {
+	buf, err := examplesFS.ReadFile("examples/" + name + ".gorun")
+	if err != nil {
+		return "", fmt.Errorf("no example named %q, see gorun -examples", name)
+	}
+	return stripShebang(string(buf)), nil
+}
+
+// exampleDoc returns the first line of the doc comment of an example
+func exampleDoc(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if doc, found := strings.CutPrefix(line, "// "); found {
+			return doc
+		}
+	}
+	return ""
+}
+
+func showExamples() {
+	fmt.Printf("examples, run with gorun -example <name> [args]:\n")
+	for _, name := range exampleNames() {
+		s, _ := exampleSource(name)
+		fmt.Printf("  %-8s %s\n", name, exampleDoc(s))
+	}
+}
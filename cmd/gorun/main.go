@@ -6,18 +6,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bir3/gocompiler"
 	"github.com/bir3/gorun"
 	"github.com/bir3/gorun/cache"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 func readFileAndStrip(filename string) string {
@@ -36,7 +45,11 @@ func readFileAndStrip(filename string) string {
 		}
 		s = string(b)
 	}
+	return stripShebang(s)
+}
 
+// stripShebang removes a first line starting with #!
+func stripShebang(s string) string {
 	if strings.HasPrefix(s, "#!") {
 		i := strings.Index(s, "\n")
 		if i < 0 {
@@ -47,9 +60,94 @@ func readFileAndStrip(filename string) string {
 	return s
 }
 
+// toUTF8 transcodes s from the named encoding, e.g. latin1 or windows-1252
+// - empty name means s must already be UTF-8
+func toUTF8(s string, encodingName string) string {
+	if encodingName == "" {
+		if !utf8.ValidString(s) {
+			errExit("source is not valid UTF-8, use -encoding to transcode")
+		}
+		return s
+	}
+	enc, err := htmlindex.Get(encodingName)
+	if err != nil {
+		usageErrExit(fmt.Sprintf("unknown encoding %s", encodingName))
+	}
+	out, err := enc.NewDecoder().String(s)
+	if err != nil {
+		errExit(fmt.Sprintf("transcode from %s failed: %s", encodingName, err))
+	}
+	return out
+}
+
+// exit codes of -strict-exit, the exit code of the program is passed through
+const (
+	exitUsage   = 2  // bad options
+	exitOther   = 3  // any other failure, also without -strict-exit
+	exitCompile = 10 // the script does not compile
+	exitCache   = 11 // the cache can not be used
+	exitTimeout = 12 // -get-timeout, -build-timeout or -wait expired
+)
+
+// strictExit is set by -strict-exit, also before the options are parsed
+// so that errors in the options use its exit code
+var strictExit = hasStrictExit(os.Args[1:])
+
+// hasStrictExit is true if -strict-exit is among the gorun options
+func hasStrictExit(args []string) bool {
+	for _, arg := range args {
+		if arg == "-strict-exit" || arg == "--strict-exit" {
+			return true
+		}
+		if !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			return false // filename
+		}
+	}
+	return false
+}
+
+// errExit exits for a failure that has no code of its own, e.g. a file
+// that can not be read
 func errExit(msg string) {
+	errExitCode(exitOther, msg)
+}
+
+// usageErrExit is errExit for bad options
+func usageErrExit(msg string) {
+	code := exitOther
+	if strictExit {
+		code = exitUsage
+	}
+	errExitCode(code, msg)
+}
+
+// cacheErrExit is errExit for a cache that can not be used
+func cacheErrExit(msg string) {
+	code := exitOther
+	if strictExit {
+		code = exitCache
+	}
+	errExitCode(code, msg)
+}
+
+func errExitCode(code int, msg string) {
 	fmt.Fprintf(os.Stderr, "ERROR: %s\n", msg)
-	os.Exit(3)
+	os.Exit(code)
+}
+
+// compileExitCode is the exit code for a failed compile
+func compileExitCode(err error) int {
+	if !strictExit {
+		return 17
+	}
+	var cacheErr *gorun.CacheError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, cache.ErrWaitTimeout):
+		return exitTimeout
+	case errors.As(err, &cacheErr):
+		return exitCache
+	}
+	return exitCompile
 }
 
 func showUsage() {
@@ -59,28 +157,475 @@ usage:
 
   -h     show this help
   -v     show version
+         add -json to show the versions and cache folder as JSON
   -c     show cache size
+         add -v to show compiles and evictions, -reset-stats to reset them
+         or -json to show size and limits as JSON, e.g. for monitoring
   -show  show code cache location
+  -o <file>
+         write the executable to file instead of running it
+  -where show the cache folders considered, one per line:
+         source, folder, active|unused, writable|readonly, reason
+  -self-update
+         check for a newer gorun release, add -yes to install it
+  -e <code> [program options]
+         run a snippet of go code, e.g. gorun -e 'fmt.Println(1+2)',
+         as the body of main with fmt, os and strings imported as used;
+         code with package main is run as is
+  -wrap  run a script without package clause: top-level import, func,
+         var, const and type declarations stay, the other statements
+         become the body of main; fmt, os and strings imported as used
+  -examples
+         list the example scripts built into gorun
+  -example <name> [program options]
+         run a built-in example, e.g. gorun -example hello
+  -dry-compile
+         show build folder and go.mod without building
+  -build-only
+         compile into the cache and print the build folder, but do
+         not run the program, e.g. to fill a cache for deployment
+  -purge <file>
+         delete the cached executable of the script, so the next run
+         compiles it again; with the same options as the run, e.g. -debug
+  -print-exe
+         compile and print the path of the executable without running
+         it, e.g. dlv exec $(gorun -debug -print-exe script.go)
   -shell enter shell at cache location
   -trim  clean cache now
+         add -report to print what was deleted as JSON
+         add -max-size <size> to also delete the least recently used
+         items until the cache is smaller, e.g. 500M, and
+         -evict-policy lfu to delete the least often used first
+         add -fix-permissions to first add the missing permissions
+         to the entries of this user that trim can not delete
+  -verify
+         check that each cached item has its executable, e.g. after
+         a full disk; add -repair to delete the broken items
+  -prewarm-shebang <dir> [-ledger <file> [-resume]]
+         compile all scripts in dir with a gorun shebang line;
+         -ledger records the progress in file and -resume skips
+         the scripts that it records as done, e.g. after Ctrl-C
+  -install-dir <dir> [-bin <bindir>]
+         prewarm the scripts in dir and link each into bindir, without
+         the .go suffix, to run them from PATH; safe to repeat
+  -trace <file>
+         write the time of each step, e.g. go build, to file in the
+         Chrome trace format for chrome://tracing or ui.perfetto.dev
+  -encoding <name>
+         transcode source from encoding, e.g. latin1 or windows-1252
+  -toolchain <embedded|path|version>
+         compile with the embedded toolchain (default), the go command
+         at path or a go version like go1.21.5 found in PATH
+  -vet   run go vet after the build and fail if it reports issues,
+         needs -toolchain as vet is not part of the embedded toolchain
+  -debug compile without optimizations and inlining for a debugger,
+         the executable is larger and slower
+  -race  build with the race detector, needs a C compiler for cgo
+  -GOOS <os> -GOARCH <arch>
+         cross-compile for another target, needs -o <file>, e.g.
+         -GOOS js -GOARCH wasm -o main.wasm for the browser
+  -path-key
+         add the absolute path of the script to the cache key, so the
+         same content at another path gets its own executable
+  -tmpdir <dir>
+         folder for the scratch files of the toolchain instead of TMPDIR,
+         e.g. if TMPDIR is too small for a build; also GORUN_TMPDIR=<dir>
+  -stdin-file <file>
+         run the program as a child process with stdin read from file
+  -max-binary-size <size>
+         fail a compile that produces a larger executable, size in
+         bytes or with suffix k, M or G, e.g. 200M
+  -get-timeout <duration>
+  -build-timeout <duration>
+         fail a compile when go get or go build takes longer, e.g. 30s
+  -wait <duration>
+         if another process compiles the script, show its pid and
+         wait at most duration for it, e.g. 5m
+  -benchmark [-n <count>]
+         compile the script and run it count times, default 10, as a
+         child process; shows min, median, max and total wall time.
+         The stdout of the program is discarded
+  -capture-env <file>
+         compile the script and write everything that enters the cache
+         key, e.g. versions and flags, and the result as JSON to file
+  -replay-env <file>
+         compile a script captured with -capture-env with an empty cache,
+         show how the cache key differs here and if the result is the same
+  -deps-graph
+         compile the script and show its module dependency graph
+  -who   show if another process compiles the script and its pid
+  -allow-unsafe-cache
+         run a cached executable that another user could have replaced,
+         e.g. as root from a cache folder writable by others
+  -repl  read lines from stdin and run each with the functions of the
+         script; an expression is printed. Each line is a separate
+         compiled program: no variables survive between lines
+  -bundle <out> <script>...
+         compile scripts and pack the executables into file out
+  -run-bundle <bundle> <script> [program options]
+         run the executable for script from a bundle without compiling
+  -hash-only-source
+         cache on source and build flags only, not on versions and
+         environment; only safe if all users have identical environments
+  -isolated
+         compile with new, empty GOCACHE, GOMODCACHE and GOPATH and
+         no gorun cache, e.g. to reproduce a build problem; slow
+  -no-cache
+         compile into a temporary folder that is removed after the run,
+         so a stale cached executable is never run
+  -run-as-module
+         build the script together with the other .go files in its folder
+  -ldx key=value
+         set string variable main.key to value at link time, can be repeated
+  -strict-exit
+         exit with a code for the kind of failure instead of 3 or 17:
+         2 usage error, 10 compile error, 11 cache error, 12 timeout,
+         3 any other error; otherwise the exit code of the program
 
   filename or "-" for stdin; first line can be #! /usr/bin/env gorun
+  filename can be a folder: its .go files are built together, main.go
+  is the script with the directives
+
+  GORUN_CACHE=<dir> uses dir as the cache folder, must be absolute;
+  each cache layout version has its own subfolder, e.g. v1
+  GORUN_ALLOW_URL=1 allows an http or https URL instead of filename,
+  e.g. of a gist; the script is downloaded on each run, at most 10 MB
+  within 30 seconds, and compiled once for each content and URL
+  GORUN_COMPILE_LOG=<file> appends a JSON line per run to file with
+  cache hit or miss, compile time and build folder
+
+  the comment block before the package clause can hold directives:
+    // gorun:flags <go build flags>
+    // gorun:require <module> <version>
+    // gorun:lang <go version>
+    // gorun:min-go <go version>
+    // gorun:go <go version>  (lang and min-go)
+    // gorun:args <program arguments>
+    // gorun:env KEY=value
+    // gorun:embed <files next to the script for go:embed>
 `
 	fmt.Printf("%s\n", strings.TrimSpace(helpStr))
 
 }
 
-func showCacheUsage() {
+func showCacheStats(reset bool) {
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+	if reset {
+		err = c.ResetStats()
+		if err != nil {
+			cacheErrExit(fmt.Sprintf("%s", err))
+		}
+	}
+	counters, err := c.GetStats()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("%s", err))
+	}
+	fmt.Printf("%d compiles, %d evictions since %s\n", counters.Compiles, counters.Evictions, counters.Since.Format("2006-01-02"))
+}
+
+func showCacheUsage(asJSON bool) {
 	c, err := cache.DefaultConfig()
 
 	if err != nil {
-		errExit(fmt.Sprintf("cache init failed: %s", err))
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
 	}
 	info, err := c.GetInfo()
 	if err != nil {
-		errExit(fmt.Sprintf("cache stat error : %s", err))
+		cacheErrExit(fmt.Sprintf("cache stat error : %s", err))
+	}
+	if asJSON {
+		out := struct {
+			cache.Stat
+			MaxAgeSeconds int64 // zero = never expire
+			MaxBytes      int64 // zero = no limit
+		}{info, int64(c.MaxAge().Seconds()), c.MaxBytes()}
+		buf, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		fmt.Printf("%s\n", buf)
+		return
 	}
 	fmt.Printf("cache size is %d MB for %d items in %s\n", info.SizeBytes/1e6, info.Count, info.Dir)
+	if c.MaxBytes() > 0 {
+		fmt.Printf("cache size limit is %d MB\n", c.MaxBytes()/1e6)
+	}
+}
+
+// showVersionInfo shows the gorun and gocompiler versions, with the cache
+// folder if asJSON, e.g. for a wrapper script that needs a minimum version
+func showVersionInfo(asJSON bool) {
+	if !asJSON {
+		fmt.Printf("gorun %s gocompiler %s\n", gorun.GorunVersion(), gocompiler.GoVersion())
+		return
+	}
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+	out := struct {
+		Gorun      string `json:"gorun"`
+		Gocompiler string `json:"gocompiler"`
+		CacheDir   string `json:"cacheDir"`
+	}{gorun.GorunVersion(), gocompiler.GoVersion(), c.Dir()}
+	buf, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	fmt.Printf("%s\n", buf)
+}
+
+// showCompiling shows which process, if any, compiles the script
+func showCompiling(c *cache.Config, info *gorun.RunInfo, s string, input string) {
+	owner, active, err := gorun.Compiling(c, info, s, input)
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("%s", err))
+	}
+	switch {
+	case active:
+		fmt.Printf("compile in progress by pid %d on %s\n", owner.Pid, owner.Host)
+	case owner.Pid != 0:
+		fmt.Printf("no compile in progress, pid %d on %s did not finish its compile\n", owner.Pid, owner.Host)
+	default:
+		fmt.Printf("no compile in progress\n")
+	}
+}
+
+// showLocations prints one tab separated line per cache location
+func showLocations() {
+	for _, loc := range cache.Locations() {
+		dir, active, writable := loc.Dir, "unused", "readonly"
+		if dir == "" {
+			dir, writable = "-", "-"
+		}
+		if loc.Active {
+			active = "active"
+		}
+		if loc.Writable {
+			writable = "writable"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", loc.Source, dir, active, writable, loc.Reason)
+	}
+}
+
+// siblingFiles returns the other .go files in the folder of filename,
+// excluding tests
+func siblingFiles(filename string) map[string]string {
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || name == filepath.Base(filename) ||
+			!strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if name == "main.go" {
+			errExit(fmt.Sprintf("-run-as-module: %s conflicts with the script, rename it", name))
+		}
+		b, err := os.ReadFile(filepath.Join(filepath.Dir(filename), name))
+		if err != nil {
+			errExit(fmt.Sprintf("failed to read file %s", name))
+		}
+		files[name] = string(b)
+	}
+	return files
+}
+
+// scriptInput returns the cache input added by the gorun command
+func scriptInput() string {
+	// input must embed everything that affects the computation:
+	// = executables, env-vars, commandline
+	// but not the script path: the same content from any folder, user
+	// or machine shares a cache entry
+	return fmt.Sprintf("// gorun: %s\n", gorun.GorunVersion())
+}
+
+// ldxFlags translates key=value pairs to a single -ldflags value
+func ldxFlags(ldx []string) string {
+	var flags []string
+	for _, kv := range ldx {
+		x := "main." + kv
+		if strings.ContainsAny(x, " \t\"") {
+			x = "'" + x + "'"
+		} else if strings.Contains(x, "'") {
+			x = `"` + x + `"`
+		}
+		flags = append(flags, "-X", x)
+	}
+	return strings.Join(flags, " ")
+}
+
+// parseSize parses a size in bytes with an optional suffix k, M or G
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1e3
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1e6
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1e9
+	}
+	digits := s
+	if multiplier != 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// signalContext is like signal.NotifyContext but signalExit returns the
+// exit code of a shell for the signal that cancelled ctx: 128+signal,
+// e.g. 130 for Ctrl-C and 143 for SIGTERM
+func signalContext(signals ...os.Signal) (ctx context.Context, signalExit func() int, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	var sig os.Signal
+	go func() {
+		select {
+		case sig = <-received:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	signalExit = func() int {
+		<-ctx.Done() // sig is written before cancel
+		if n, ok := sig.(syscall.Signal); ok {
+			return 128 + int(n)
+		}
+		return 130
+	}
+	stop = func() {
+		signal.Stop(received)
+		cancel()
+	}
+	return ctx, signalExit, stop
+}
+
+// showPermissionIssues explains why trim could not delete some entries;
+// with fix it first adds the missing permissions to entries of this user
+func showPermissionIssues(c *cache.Config, fix bool) {
+	check := c.CheckPermissions
+	if fix {
+		check = c.FixPermissions
+	}
+	issues, err := check()
+	if err != nil || len(issues) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %d cache entries can not be deleted by this user:\n", len(issues))
+	const maxShow = 10
+	for i, issue := range issues {
+		if i == maxShow {
+			fmt.Fprintf(os.Stderr, "  ...\n")
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", issue.Path, issue.Problem)
+	}
+	if !fix {
+		fmt.Fprintf(os.Stderr, "entries of this user can be fixed with gorun -trim -fix-permissions\n")
+	}
+}
+
+// verifyCache prints the broken items of the cache, false if any
+// remain or on error
+func verifyCache(repair bool) bool {
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+	var verifyReport cache.VerifyReport
+	if repair {
+		verifyReport, err = c.Repair()
+	} else {
+		verifyReport, err = c.Verify()
+	}
+	for _, item := range verifyReport.Broken {
+		fmt.Printf("broken: %s: %s\n", item.Itemdir, item.Problem)
+	}
+	fmt.Printf("verified %d items, %d broken, %d deleted\n", verifyReport.ItemsScanned, len(verifyReport.Broken), verifyReport.ItemsDeleted)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return false
+	}
+	return len(verifyReport.Broken) == verifyReport.ItemsDeleted
+}
+
+// runNoCache compiles with an empty temporary cache and runs the program
+// as a child process, not with exec, so the cache can be removed afterwards
+func runNoCache(info *gorun.RunInfo, s string, args []string, stdin *os.File) int {
+	outdir, cleanup, err := gorun.CompileStringNoCache(info, s, args, scriptInput())
+	defer cleanup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return compileExitCode(err)
+	}
+	return runChild(outdir, s, args, stdin)
+}
+
+// copyExecutable copies exefile to dst, replacing dst atomically
+func copyExecutable(exefile string, dst string) error {
+	if fileinfo, err := os.Stat(dst); err == nil && fileinfo.IsDir() {
+		return fmt.Errorf("-o %s is a directory", dst)
+	}
+	src, err := os.Open(exefile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcinfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".gorun-o-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s - %w", dst, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Chmod(srcinfo.Mode().Perm())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s - %w", dst, err)
+	}
+	return nil
+}
+
+// runChild runs the program in outdir as a child process and returns
+// its exit code, 128+signal if killed by a signal as with a shell
+func runChild(outdir string, s string, args []string, stdin *os.File) int {
+	exefile := filepath.Join(outdir, "main")
+	d, _ := gorun.ParseDirectives(s) // already validated by compile
+	cmd := exec.Command(exefile, append(d.Args, args...)...)
+	cmd.Env = d.Environ(os.Environ())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return gorun.ExitStatus(exitErr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 17
+	}
+	return 0
 }
 
 func main() {
@@ -90,14 +635,68 @@ func main() {
 		gocompiler.RunToolchain()
 		return
 	}
+	start := time.Now()
 
 	show := false
+	dryCompile := false
 	shell := false
 	trimFlag := false
+	report := false
+	fixPermissions := false
+	verifyFlag := false
+	repair := false
 	showVersion := false
 	showCache := false
+	where := false
+	examples := false
+	selfUpdateFlag := false
+	yes := false
+	example := false
+	snippet := false
+	wrap := false
+	pathKey := false
+	resetStats := false
+	jsonFlag := false
 
 	help := false
+	nModifiers := 0 // options that modify another option
+	var ldx []string
+	prewarmDir := ""
+	installDirFlag := ""
+	ledgerFile := ""
+	resume := false
+	binDir := ""
+	traceFile := ""
+	encoding := ""
+	toolchain := ""
+	runAsModule := false
+	isolated := false
+	noCache := false
+	stdinFile := ""
+	tmpDir := os.Getenv("GORUN_TMPDIR")
+	goos, goarch := "", ""
+	outFile := ""
+	allowUnsafeCache := false
+	var maxBinarySize int64
+	var maxCacheSize int64
+	evictPolicy := ""
+	replFlag := false
+	who := false
+	depsGraph := false
+	captureFile := ""
+	buildOnly := false
+	printExe := false
+	purge := false
+	replayFile := ""
+	benchmarkFlag := false
+	benchmarkRuns := 0
+	hashOnlySource := false
+	bundleFile := ""
+	runBundleFile := ""
+	var getTimeout, buildTimeout, wait time.Duration
+	debug := false
+	race := false
+	vet := false
 	var arg, filename string
 	var programArgs []string
 	args := append([]string(nil), os.Args[1:]...)
@@ -114,15 +713,223 @@ func main() {
 				showVersion = true
 			case "-c":
 				showCache = true
+			case "-json":
+				jsonFlag = true
+				nModifiers++
+			case "-reset-stats":
+				resetStats = true
+				nModifiers++
+			case "-where", "-list-cache-locations":
+				where = true
+			case "-examples":
+				examples = true
+			case "-self-update":
+				selfUpdateFlag = true
+			case "-yes":
+				yes = true
+				nModifiers++
+			case "-example":
+				example = true
+			case "-e":
+				snippet = true
+			case "-wrap":
+				wrap = true
+			case "-path-key":
+				pathKey = true
 			case "-show":
 				// show code
 				show = true
+			case "-dry-compile":
+				dryCompile = true
+			case "-build-only":
+				buildOnly = true
+			case "-print-exe":
+				printExe = true
+			case "-purge":
+				purge = true
 			case "-shell":
 				shell = true
 			case "-trim":
 				trimFlag = true
+			case "-report":
+				report = true
+				nModifiers++
+			case "-fix-permissions":
+				fixPermissions = true
+				nModifiers++
+			case "-verify":
+				verifyFlag = true
+			case "-repair":
+				repair = true
+				nModifiers++
+			case "-max-size":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a size", arg))
+				}
+				size, err := parseSize(args[0])
+				if err != nil || size <= 0 {
+					usageErrExit(fmt.Sprintf("%s - bad size %s", arg, args[0]))
+				}
+				maxCacheSize, args = size, args[1:]
+				nModifiers += 2
+			case "-evict-policy":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires lru or lfu", arg))
+				}
+				evictPolicy, args = args[0], args[1:]
+				nModifiers += 2
+			case "-prewarm-shebang":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a directory", arg))
+				}
+				prewarmDir, args = args[0], args[1:]
+			case "-ledger":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a file", arg))
+				}
+				ledgerFile, args = args[0], args[1:]
+			case "-resume":
+				resume = true
+			case "-install-dir":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a directory", arg))
+				}
+				installDirFlag, args = args[0], args[1:]
+			case "-bin":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a directory", arg))
+				}
+				binDir, args = args[0], args[1:]
+			case "-capture-env", "-replay-env":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a file", arg))
+				}
+				if arg == "-capture-env" {
+					captureFile = args[0]
+				} else {
+					replayFile = args[0]
+				}
+				args = args[1:]
+			case "-trace":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a file", arg))
+				}
+				traceFile, args = args[0], args[1:]
+			case "-encoding":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires an encoding name", arg))
+				}
+				encoding, args = args[0], args[1:]
+			case "-toolchain":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires embedded, a path or a version", arg))
+				}
+				toolchain, args = args[0], args[1:]
+			case "-run-as-module":
+				runAsModule = true
+			case "-debug":
+				debug = true
+			case "-race":
+				race = true
+			case "-strict-exit":
+				strictExit = true // already set by hasStrictExit
+				nModifiers++
+			case "-vet":
+				vet = true
+			case "-stdin-file":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a file", arg))
+				}
+				stdinFile, args = args[0], args[1:]
+			case "-tmpdir":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a folder", arg))
+				}
+				tmpDir, args = args[0], args[1:]
+			case "-GOOS", "-GOARCH":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a value, e.g. -GOOS js -GOARCH wasm", arg))
+				}
+				if arg == "-GOOS" {
+					goos = args[0]
+				} else {
+					goarch = args[0]
+				}
+				args = args[1:]
+			case "-o":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a file", arg))
+				}
+				outFile, args = args[0], args[1:]
+			case "-max-binary-size":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a size", arg))
+				}
+				size, err := parseSize(args[0])
+				if err != nil {
+					usageErrExit(fmt.Sprintf("%s - %s", arg, err))
+				}
+				maxBinarySize, args = size, args[1:]
+			case "-get-timeout", "-build-timeout", "-wait":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a duration", arg))
+				}
+				timeout, err := time.ParseDuration(args[0])
+				if err != nil || timeout <= 0 {
+					usageErrExit(fmt.Sprintf("%s - bad duration %q", arg, args[0]))
+				}
+				switch arg {
+				case "-get-timeout":
+					getTimeout = timeout
+				case "-build-timeout":
+					buildTimeout = timeout
+				default:
+					wait = timeout
+				}
+				args = args[1:]
+			case "-allow-unsafe-cache":
+				allowUnsafeCache = true
+			case "-bundle", "-run-bundle":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a bundle file", arg))
+				}
+				if arg == "-bundle" {
+					bundleFile = args[0]
+				} else {
+					runBundleFile = args[0]
+				}
+				args = args[1:]
+			case "-hash-only-source":
+				hashOnlySource = true
+			case "-repl":
+				replFlag = true
+			case "-who":
+				who = true
+			case "-benchmark":
+				benchmarkFlag = true
+			case "-n":
+				if len(args) == 0 {
+					usageErrExit(fmt.Sprintf("%s requires a count", arg))
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 1 {
+					usageErrExit(fmt.Sprintf("%s - bad count %s", arg, args[0]))
+				}
+				benchmarkRuns, args = n, args[1:]
+			case "-deps-graph":
+				depsGraph = true
+			case "-isolated":
+				isolated = true
+			case "-no-cache":
+				noCache = true
+			case "-ldx":
+				if len(args) == 0 || !strings.Contains(args[0], "=") || strings.HasPrefix(args[0], "=") {
+					usageErrExit(fmt.Sprintf("%s requires key=value", arg))
+				}
+				ldx = append(ldx, args[0])
+				args = args[1:]
 			default:
-				errExit(fmt.Sprintf("unknown option %s", arg))
+				usageErrExit(fmt.Sprintf("unknown option %s", arg))
 			}
 		} else {
 			filename, programArgs = arg, args
@@ -133,62 +940,427 @@ func main() {
 	}
 
 	// validate flags:
-	singleOption := len(os.Args) == 2
+	verbose := false
+	if showCache && showVersion {
+		// -c -v = verbose cache info
+		verbose, showVersion = true, false
+		nModifiers++
+	}
+	if resetStats && !showCache {
+		showUsage()
+		usageErrExit("-reset-stats is only valid with -c")
+	}
+	if jsonFlag && !showVersion && (!showCache || verbose || resetStats) {
+		showUsage()
+		usageErrExit("-json is only valid with -v, or with -c without -v and -reset-stats")
+	}
+	singleOption := len(os.Args)-nModifiers == 2
+
+	if vet && (toolchain == "" || toolchain == "embedded") {
+		showUsage()
+		usageErrExit("-vet needs an external toolchain, e.g. -toolchain go1.22.0")
+	}
+	if report && !trimFlag {
+		showUsage()
+		usageErrExit("-report is only valid with -trim")
+	}
+	if fixPermissions && !trimFlag {
+		showUsage()
+		usageErrExit("-fix-permissions is only valid with -trim")
+	}
+	if repair && !verifyFlag {
+		showUsage()
+		usageErrExit("-repair is only valid with -verify")
+	}
+	if maxCacheSize > 0 && !trimFlag {
+		showUsage()
+		usageErrExit("-max-size is only valid with -trim")
+	}
+	policy := cache.EvictLRU
+	switch evictPolicy {
+	case "", "lru":
+	case "lfu":
+		policy = cache.EvictLFU
+	default:
+		usageErrExit(fmt.Sprintf("unknown evict policy %s, use lru or lfu", evictPolicy))
+	}
+	if evictPolicy != "" && maxCacheSize == 0 {
+		showUsage()
+		usageErrExit("-evict-policy is only valid with -max-size")
+	}
+	if benchmarkRuns > 0 && !benchmarkFlag {
+		showUsage()
+		usageErrExit("-n is only valid with -benchmark")
+	}
+	if benchmarkFlag && benchmarkRuns == 0 {
+		benchmarkRuns = 10
+	}
+	if yes && !selfUpdateFlag {
+		showUsage()
+		usageErrExit("-yes is only valid with -self-update")
+	}
 
-	if (trimFlag || showVersion || showCache || help) && !singleOption {
+	if (trimFlag || verifyFlag || showVersion || showCache || where || examples || selfUpdateFlag || help) && !singleOption {
 		showUsage()
-		errExit(fmt.Sprintf("extra arguments: %s", os.Args[1:]))
+		usageErrExit(fmt.Sprintf("extra arguments: %s", os.Args[1:]))
 	}
 
 	if showVersion {
-		fmt.Printf("gorun %s gocompiler %s\n", gorun.GorunVersion(), gocompiler.GoVersion())
+		showVersionInfo(jsonFlag)
 		return
 	}
 	if showCache {
-		showCacheUsage()
+		showCacheUsage(jsonFlag)
+		if verbose || resetStats {
+			showCacheStats(resetStats)
+		}
 		return
 	}
 	if help {
 		showUsage()
 		return
 	}
+	if where {
+		showLocations()
+		return
+	}
+	if examples {
+		showExamples()
+		return
+	}
+	if selfUpdateFlag {
+		err := selfUpdate(yes)
+		if err != nil {
+			errExit(fmt.Sprintf("self-update failed: %s", err))
+		}
+		return
+	}
+
+	var trace *gorun.Trace
+	writeTrace := func() {}
+	if traceFile != "" {
+		trace = gorun.NewTrace()
+		writeTrace = func() {
+			trace.Span("gorun", start)
+			err := trace.WriteFile(traceFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: failed to write trace - %s\n", err)
+			}
+		}
+	}
+
+	if binDir != "" && installDirFlag == "" {
+		showUsage()
+		usageErrExit("-bin is only valid with -install-dir")
+	}
+	if installDirFlag != "" {
+		if filename != "" {
+			usageErrExit(fmt.Sprintf("extra arguments: %s", filename))
+		}
+		ok := installDir(installDirFlag, binDir, trace)
+		writeTrace()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if (ledgerFile != "" || resume) && prewarmDir == "" {
+		showUsage()
+		usageErrExit("-ledger and -resume are only valid with -prewarm-shebang")
+	}
+	if resume && ledgerFile == "" {
+		showUsage()
+		usageErrExit("-resume needs -ledger <file>")
+	}
+	if prewarmDir != "" {
+		if filename != "" {
+			usageErrExit(fmt.Sprintf("extra arguments: %s", filename))
+		}
+		var ledger *prewarmLedger
+		if ledgerFile != "" {
+			var err error
+			ledger, err = openLedger(ledgerFile, prewarmDir, resume)
+			if err != nil {
+				errExit(fmt.Sprintf("%s", err))
+			}
+		}
+		ok := prewarmShebang(prewarmDir, &gorun.RunInfo{Trace: trace, Toolchain: toolchain}, ledger)
+		writeTrace()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if replayFile != "" {
+		if filename != "" {
+			usageErrExit(fmt.Sprintf("extra arguments: %s", filename))
+		}
+		if !replayEnv(replayFile) {
+			os.Exit(1)
+		}
+		return
+	}
 
 	if trimFlag {
 		c, err := cache.DefaultConfig()
-		fmt.Printf("Start trim ...\n")
+		if err == nil && maxCacheSize > 0 {
+			// open again with the limit, maxAge is read from config.json
+			c, err = cache.NewConfigWithOptions(c.Dir(), 10*24*time.Hour, cache.Options{MaxBytes: maxCacheSize, EvictPolicy: policy})
+		}
+		if !report {
+			fmt.Printf("Start trim ...\n")
+		}
+		var trimReport cache.TrimReport
 		if err == nil {
-			err = c.TrimNow()
+			trimReport, err = c.TrimNow()
+		}
+		if c != nil && (err == nil || errors.Is(err, os.ErrPermission)) {
+			showPermissionIssues(c, fixPermissions)
+		}
+		if report {
+			// report partial work also on error
+			buf, jsonErr := json.MarshalIndent(trimReport, "", "  ")
+			if jsonErr != nil {
+				errExit(fmt.Sprintf("%s", jsonErr))
+			}
+			fmt.Printf("%s\n", buf)
 		}
 		if err != nil {
-			errExit(fmt.Sprintf("%s", err))
+			cacheErrExit(fmt.Sprintf("%s", err))
+		}
+		if report {
+			return
+		}
+		fmt.Printf("freed %d items, %d MB\n", trimReport.ItemsDeleted, trimReport.BytesFreed/1e6)
+		showCacheUsage(false)
+		return
+	}
+
+	if verifyFlag {
+		if !verifyCache(repair) {
+			os.Exit(1)
 		}
-		showCacheUsage()
 		return
 	}
 
 	if filename == "" {
 		showUsage()
-		errExit("missing file to run")
+		usageErrExit("missing file to run")
 
 	}
+	if bundleFile != "" {
+		bundle(bundleFile, append([]string{filename}, programArgs...))
+		return
+	}
+	if runBundleFile != "" {
+		c, err := cache.DefaultConfig()
+		if err != nil {
+			cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+		}
+		exefile, entry, err := readBundle(c, runBundleFile, filename)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		if !allowUnsafeCache {
+			err = c.CheckExec(exefile)
+			if err != nil {
+				cacheErrExit(fmt.Sprintf("%s", err))
+			}
+		}
+		d := gorun.Directives{Args: entry.Args, Env: entry.Env}
+		for _, kv := range d.Environ(nil) {
+			k, v, _ := strings.Cut(kv, "=")
+			if _, found := os.LookupEnv(k); !found {
+				os.Setenv(k, v)
+			}
+		}
+		err = gorun.Exec(exefile, append(d.Args, programArgs...))
+		errExit(fmt.Sprintf("exec failed: %s", err))
+	}
 	var err error
-	if filename != "-" {
-		filename, err = filepath.Abs(filename)
+	var s string
+	var dirFiles map[string]string // script split over the files of a folder
+	fromURL := !example && !snippet && isScriptURL(filename)
+	if example {
+		s, err = exampleSource(filename)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+	} else if snippet {
+		s = snippetSource(filename)
+	} else if fromURL {
+		s, err = fetchScript(filename)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		s = toUTF8(stripShebang(s), encoding)
+	} else {
+		if filename != "-" {
+			filename, err = filepath.Abs(filename)
+			if err != nil {
+				errExit(fmt.Sprintf("%s", err))
+			}
+		}
+		if fileinfo, err := os.Stat(filename); err == nil && fileinfo.IsDir() {
+			s, dirFiles, err = gorun.DirSources(filename)
+			if err != nil {
+				errExit(fmt.Sprintf("%s", err))
+			}
+			s = toUTF8(stripShebang(s), encoding)
+			for name, content := range dirFiles {
+				dirFiles[name] = toUTF8(content, encoding)
+			}
+		} else {
+			s = toUTF8(readFileAndStrip(filename), encoding)
+		}
+	}
+	if wrap {
+		s, err = wrapSource(s)
+		if err != nil {
+			errExit(fmt.Sprintf("-wrap: %s", err))
+		}
+	}
+
+	if tmpDir != "" {
+		tmpDir, err = filepath.Abs(tmpDir)
 		if err != nil {
 			errExit(fmt.Sprintf("%s", err))
 		}
 	}
-	s := readFileAndStrip(filename)
+
+	info := &gorun.RunInfo{
+		Toolchain:      toolchain,
+		Debug:          debug,
+		Race:           race,
+		Vet:            vet,
+		MaxBinarySize:  maxBinarySize,
+		GetTimeout:     getTimeout,
+		BuildTimeout:   buildTimeout,
+		HashOnlySource: hashOnlySource,
+		Wait:           wait,
+		Trace:          trace,
+		TempDir:        tmpDir,
+		GOOS:           goos,
+		GOARCH:         goarch,
+		Waiting: func(pid int) {
+			if pid == 0 {
+				fmt.Fprintf(os.Stderr, "waiting for compile by another process\n")
+			} else {
+				fmt.Fprintf(os.Stderr, "waiting for compile by pid %d\n", pid)
+			}
+		},
+	}
+	if len(ldx) > 0 {
+		info.BuildFlags = append(info.BuildFlags, "-ldflags", ldxFlags(ldx))
+	}
+	if runAsModule {
+		if filename == "-" || example || snippet || fromURL || dirFiles != nil {
+			usageErrExit("-run-as-module needs a file, not stdin, a URL, a folder, an example or -e")
+		}
+		info.Files = siblingFiles(filename)
+	}
+	if dirFiles != nil {
+		info.Files = dirFiles
+		info.ScriptDir = filename
+	} else if filename != "-" && !example && !snippet && !fromURL {
+		info.ScriptDir = filepath.Dir(filename)
+	}
+	if fromURL {
+		// the same content from another URL is another script
+		info.Name = scriptURLName(filename)
+		info.SourcePath = filename
+	} else if filename != "-" && !snippet {
+		info.Name = filepath.Base(filename)
+	}
+	if pathKey {
+		if filename == "-" || example || snippet {
+			usageErrExit("-path-key needs a file or a folder, not stdin, an example or -e")
+		}
+		info.SourcePath = filename
+	}
+	if dryCompile {
+		err = gorun.DryCompile(os.Stdout, info, s)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		return
+	}
+
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	if (goos != runtime.GOOS || goarch != runtime.GOARCH) && outFile == "" && !show && !shell && !buildOnly && !printExe {
+		usageErrExit(fmt.Sprintf("a %s/%s executable can not run here, extract it with -o <file>", goos, goarch))
+	}
+
+	stdin := os.Stdin
+	if stdinFile != "" {
+		if filename == "-" {
+			usageErrExit("-stdin-file can not be combined with a script from stdin")
+		}
+		f, err := os.Open(stdinFile)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+		stdin = f // closed on exit
+	}
+
+	if replFlag {
+		if filename == "-" || stdinFile != "" || isolated || noCache {
+			usageErrExit("-repl reads lines from stdin and needs a script file")
+		}
+		repl(info, s)
+		return
+	}
+
+	if isolated || noCache {
+		flag := "-no-cache"
+		if isolated {
+			flag = "-isolated"
+		}
+		if show || shell || outFile != "" || benchmarkFlag || buildOnly || printExe || purge {
+			usageErrExit(flag + " can not be combined with -show, -shell, -o, -benchmark, -build-only, -print-exe or -purge")
+		}
+		info.Isolated = isolated
+		os.Exit(runNoCache(info, s, programArgs, stdin))
+	}
 
 	c, err := cache.DefaultConfig()
 	if err != nil {
-		errExit(fmt.Sprintf("cache init failed: %s", err))
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
 	}
 
-	// input must embed everything that affects the computation:
-	// = executables, env-vars, commandline
-	input := fmt.Sprintf("// gorun: %s\n", gorun.GorunVersion())
-	outdir, err := gorun.CompileString(c, s, programArgs, input)
+	input := scriptInput()
+	if hashOnlySource {
+		input = ""
+	}
+	if who {
+		showCompiling(c, info, s, input)
+		return
+	}
+	if purge {
+		err = gorun.Purge(c, info, s, input)
+		if err != nil {
+			cacheErrExit(fmt.Sprintf("%s", err))
+		}
+		return
+	}
+	ctx, signalExit, stop := signalContext(os.Interrupt, syscall.SIGTERM)
+	outdir, err := gorun.CompileStringContext(ctx, c, info, s, programArgs, input)
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: interrupted\n")
+		os.Exit(signalExit())
+	}
+	stop() // restore default signal handling for the program
+	if err == nil && !show && !shell && outFile == "" && !depsGraph && !benchmarkFlag && captureFile == "" && !buildOnly && !printExe {
+		trace.Instant("exec")
+	}
+	writeTrace()
 
 	showBuildInstructions := func() {
 		exe, _ := os.Executable()
@@ -217,19 +1389,87 @@ func main() {
 		if err != nil {
 			fmt.Printf("ERROR: %s\n", err)
 		}
+	} else if outFile != "" {
+		if err == nil {
+			err = copyExecutable(filepath.Join(outdir, info.ExeName()), outFile)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(compileExitCode(err))
+		}
+	} else if buildOnly || printExe {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(compileExitCode(err))
+		}
+		if printExe {
+			fmt.Println(filepath.Join(outdir, info.ExeName()))
+		} else {
+			fmt.Println(outdir)
+		}
+	} else if captureFile != "" {
+		captureErr := captureEnv(captureFile, info, s, input, err)
+		if captureErr != nil {
+			errExit(fmt.Sprintf("%s", captureErr))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(compileExitCode(err))
+		}
+	} else if depsGraph {
+		if err == nil {
+			err = gorun.ModGraph(os.Stdout, info, outdir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(compileExitCode(err))
+		}
+	} else if benchmarkFlag {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(compileExitCode(err))
+		}
+		if !allowUnsafeCache {
+			err = c.CheckExec(filepath.Join(outdir, info.ExeName()))
+			if err != nil {
+				cacheErrExit(fmt.Sprintf("%s\na cached executable that another user can replace is not run, use -allow-unsafe-cache to run anyway", err))
+			}
+		}
+		err = benchmark(outdir, s, programArgs, benchmarkRuns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
 	} else {
 		// normal exec
-		if err == nil {
-			exefile := filepath.Join(outdir, "main")
-			// no lock => only thing protecting the executable is a recent timestamp
-			err = gorun.Exec(exefile, args)
+		if err == nil && !allowUnsafeCache {
+			err = c.CheckExec(filepath.Join(outdir, info.ExeName()))
+			if err != nil {
+				cacheErrExit(fmt.Sprintf("%s\na cached executable that another user can replace is not run, use -allow-unsafe-cache to run anyway", err))
+			}
+		}
+		if err == nil && stdinFile != "" {
+			// exec inherits stdin => spawn instead
+			os.Exit(runChild(outdir, s, programArgs, stdin))
+		} else if err == nil {
+			exefile := filepath.Join(outdir, info.ExeName())
+			d, _ := gorun.ParseDirectives(s) // already validated by compile
+			for _, kv := range d.Environ(nil) {
+				k, v, _ := strings.Cut(kv, "=")
+				if _, found := os.LookupEnv(k); !found {
+					os.Setenv(k, v)
+				}
+			}
+			// no lock => the executable is protected by a recent timestamp
+			// and the grace period of the cache, see cache.Options.Grace
+			err = gorun.Exec(exefile, append(d.Args, args...))
 			if err != nil {
 				errExit(fmt.Sprintf("exec failed: %s", err))
 			}
 			errExit("exec should not return")
 		} else {
 			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-			os.Exit(17)
+			os.Exit(compileExitCode(err))
 		}
 	}
 
@@ -5,13 +5,24 @@
 package main_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bir3/gocompiler"
 	"github.com/bir3/gorun"
@@ -242,3 +253,1650 @@ func main() {
 	fmt.Printf("RunString should never return, error = %s\n", err)
 	os.Exit(9)
 }
+
+func TestLdx(t *testing.T) {
+	t.Parallel()
+	goLdx := `package main
+
+	import "fmt"
+
+	var version = "unset"
+	var name = "unset"
+
+	func main() {
+		fmt.Printf("version=%s name=%s\n", version, name)
+	}
+	`
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(tmpdir(t), "ldx.go")
+	err = os.WriteFile(gofile, []byte(goLdx), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := exec.Command(gorun, "-ldx", "version=1.2.3", "--ldx", "name=a b", gofile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	expect := "version=1.2.3 name=a b\n"
+	if string(buf) != expect {
+		t.Fatalf("got %q but expected %q", buf, expect)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	t.Parallel()
+	// "café" in latin1 is not valid UTF-8
+	goLatin1 := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"caf\xe9\")\n}\n"
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(tmpdir(t), "latin1.go")
+	err = os.WriteFile(gofile, []byte(goLatin1), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := exec.Command(gorun, gofile).CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "not valid UTF-8") {
+		t.Fatalf("expected UTF-8 error, got %s\n%s", err, buf)
+	}
+
+	buf, err = exec.Command(gorun, "-encoding", "latin1", gofile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	expect := "café\n"
+	if string(buf) != expect {
+		t.Fatalf("got %q but expected %q", buf, expect)
+	}
+}
+
+func TestDryCompile(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(tmpdir(t), "dry.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := exec.Command(gorun, "-dry-compile", gofile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	for _, expect := range []string{" main.go\n", " go.mod\n", "module main\n"} {
+		if !strings.Contains(string(buf), expect) {
+			t.Fatalf("missing %q in output:\n%s", expect, buf)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+
+	for _, tc := range []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"-e", "fmt.Println(1+2)"}, "3\n"},
+		{[]string{"-e", "fmt.Println(strings.ToUpper(os.Args[1]))", "hi"}, "HI\n"},
+		{[]string{"-e", "println(\"no imports\")"}, "no imports\n"},
+		{[]string{"-e", "package main\n\nfunc main() { println(\"verbatim\") }\n"}, "verbatim\n"},
+	} {
+		buf, err := exec.Command(gorun, tc.args...).CombinedOutput()
+		if err != nil || string(buf) != tc.expect {
+			t.Errorf("%q: expected %q, got %v\n%s", tc.args, tc.expect, err, buf)
+		}
+	}
+
+	// the same snippet is the same program => the same cache entry
+	show := func() string {
+		buf, err := exec.Command(gorun, "-show", "-e", "fmt.Println(1+2)").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, buf)
+		}
+		return string(buf)
+	}
+	if first, second := show(), show(); first != second {
+		t.Fatalf("expected the same build folder, got\n%s\n%s", first, second)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	for name, tc := range map[string]struct {
+		code   string
+		expect string
+	}{
+		"hi":       {"fmt.Println(\"hi\")\n", "hi\n"},
+		"noimport": {"func double(x int) int {\n\treturn 2 * x\n}\n\nx := double(21)\nprintln(x)\n", "42\n"},
+		"import":   {"import \"strings\"\n\nconst n = 2\n\nfor i := 0; i < n; i++ {\n\tfmt.Println(strings.Repeat(\"ab\", i+1))\n}\n", "ab\nabab\n"},
+		"package":  {"package main\n\nfunc main() { println(\"as is\") }\n", "as is\n"},
+		"mainonly": {"func main() { println(\"own main\") }\n", "own main\n"},
+	} {
+		gofile := filepath.Join(dir, name+".go")
+		err := os.WriteFile(gofile, []byte(tc.code), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := exec.Command(gorun, "-wrap", gofile).CombinedOutput()
+		if err != nil || string(buf) != tc.expect {
+			t.Errorf("%s: expected %q, got %v\n%s", name, tc.expect, err, buf)
+		}
+	}
+}
+
+func TestBuildOnly(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+	gofile := filepath.Join(dir, "deploy.go")
+	code := fmt.Sprintf("package main\n\nimport \"os\"\n\nfunc main() {\n\tos.WriteFile(%q, nil, 0666)\n}\n", marker)
+	err = os.WriteFile(gofile, []byte(code), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := exec.Command(gorun, "-build-only", gofile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdir := strings.TrimSuffix(string(buf), "\n")
+	if _, err := os.Stat(filepath.Join(outdir, "main")); err != nil {
+		t.Fatalf("no executable in printed build folder %q - %v", buf, err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("-build-only ran the program")
+	}
+
+	broken := filepath.Join(dir, "broken.go")
+	err = os.WriteFile(broken, []byte("package main\n\nimport \"fmt\"\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gorun, "-build-only", broken)
+	buf, _ = cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() == 0 || !strings.Contains(string(buf), `"fmt" imported and not used`) {
+		t.Fatalf("expected compile error, got %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+}
+
+func TestInstallDir(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	scripts := filepath.Join(dir, "scripts")
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{scripts, bin} {
+		err := os.Mkdir(d, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"one", "two"} {
+		code := fmt.Sprintf("#! /usr/bin/env gorun\n\npackage main\n\nfunc main() { println(%q) }\n", "tool "+name)
+		err := os.WriteFile(filepath.Join(scripts, name+".go"), []byte(code), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(scripts, "README"), []byte("not a script\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	install := func(expect string) {
+		t.Helper()
+		buf, err := exec.Command(gorun, "-install-dir", scripts, "-bin", bin).CombinedOutput()
+		if err != nil || !strings.Contains(string(buf), expect) {
+			t.Fatalf("expected %q, got %v\n%s", expect, err, buf)
+		}
+	}
+	install("2 linked, 0 existed, 0 failed\n")
+	install("0 built, 2 cached, 0 failed\n") // idempotent
+	install("0 linked, 2 existed, 0 failed\n")
+
+	for _, name := range []string{"one", "two"} {
+		cmd := exec.Command(filepath.Join(bin, name))
+		cmd.Env = append(os.Environ(), "PATH="+cwd+string(os.PathListSeparator)+os.Getenv("PATH"))
+		buf, err := cmd.CombinedOutput()
+		if err != nil || string(buf) != "tool "+name+"\n" {
+			t.Fatalf("%s via link: %v\n%s", name, err, buf)
+		}
+	}
+}
+
+func TestPrintExe(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(t.TempDir(), "debugme.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"debugged\") }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gorun, "-debug", "-print-exe", gofile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	buf, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	exefile := strings.TrimSuffix(string(buf), "\n")
+	if !filepath.IsAbs(exefile) || strings.Contains(exefile, "\n") {
+		t.Fatalf("expected only an absolute path on stdout, got %q", buf)
+	}
+	fileinfo, err := os.Stat(exefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileinfo.Mode()&0111 == 0 {
+		t.Fatalf("%s is not executable: %s", exefile, fileinfo.Mode())
+	}
+	buf, err = exec.Command(exefile).CombinedOutput()
+	if err != nil || string(buf) != "debugged\n" {
+		t.Fatalf("printed executable failed: %v\n%s", err, buf)
+	}
+}
+
+func TestPrewarmResume(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	scripts := filepath.Join(dir, "scripts")
+	err = os.Mkdir(scripts, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := filepath.Join(dir, "builds.txt")
+
+	// stub toolchain that records each build and hangs on a SLOW script
+	// while STUB_SLOW is set
+	stubGo := filepath.Join(dir, "go")
+	stub := `#! /bin/sh
+if [ "$1" = env ]; then echo go1.22.0; exit 0; fi
+if [ "$1" != build ]; then exit 0; fi
+grep -h script main.go >> ` + builds + `
+if [ -n "$STUB_SLOW" ] && grep -q SLOW main.go; then exec sleep 30; fi
+`
+	err = os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, comment := range map[string]string{"a": "", "b": "// SLOW"} {
+		code := fmt.Sprintf("#! /usr/bin/env gorun\n\n// script %s\n%s\npackage main\n\nfunc main() {}\n", name, comment)
+		err := os.WriteFile(filepath.Join(scripts, name+".go"), []byte(code), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ledger := filepath.Join(dir, "ledger.txt")
+	a := filepath.Join(scripts, "a.go")
+
+	// interrupt the prewarm while it compiles b
+	cmd := exec.Command(gorun, "-toolchain", stubGo, "-prewarm-shebang", scripts, "-ledger", ledger)
+	cmd.Env = append(os.Environ(), "STUB_SLOW=1")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		buf, _ := os.ReadFile(ledger)
+		if strings.Contains(string(buf), "ok "+a+"\n") {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			cmd.Process.Kill()
+			t.Fatalf("a not recorded in ledger:\n%s", buf)
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	buf, err := exec.Command(gorun, "-toolchain", stubGo, "-prewarm-shebang", scripts, "-ledger", ledger, "-resume").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	for _, expect := range []string{"done   " + a + "\n", "built  " + filepath.Join(scripts, "b.go") + "\n", "1 built, 0 cached, 0 failed, 1 done before\n"} {
+		if !strings.Contains(string(buf), expect) {
+			t.Fatalf("missing %q in\n%s", expect, buf)
+		}
+	}
+	buf, err = os.ReadFile(builds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(buf), "script a") != 1 {
+		t.Fatalf("a was built again:\n%s", buf)
+	}
+
+	buf, err = exec.Command(gorun, "-prewarm-shebang", dir, "-ledger", ledger, "-resume").CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "is not for a prewarm of") {
+		t.Fatalf("expected error for the ledger of another folder, got %v\n%s", err, buf)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(t.TempDir(), "miscompiled.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"purge me\") }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(option string) string {
+		t.Helper()
+		buf, err := exec.Command(gorun, option, gofile).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", option, err, buf)
+		}
+		return strings.TrimSuffix(string(buf), "\n")
+	}
+	if out := run("-purge"); out != "" {
+		t.Fatalf("expected no output for a script not in the cache, got %q", out)
+	}
+	outdir := run("-build-only")
+	run("-purge")
+	if _, err := os.Stat(outdir); !os.IsNotExist(err) {
+		t.Fatalf("%s not purged: %v", outdir, err)
+	}
+	if run("-build-only") == outdir {
+		t.Fatal("expected a new build folder after -purge")
+	}
+}
+
+func TestRunAsModule(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := filepath.Join(t.TempDir(), "module")
+	err = os.Mkdir(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"script.go": "#! /usr/bin/env gorun\npackage main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(helper())\n}\n",
+		"helper.go": "package main\n\nfunc helper() string {\n\treturn \"from helper\"\n}\n",
+		"x_test.go": "package main\n\nthis is not compiled\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := exec.Command(gorun, "-run-as-module", filepath.Join(dir, "script.go")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	expect := "from helper\n"
+	if string(buf) != expect {
+		t.Fatalf("got %q but expected %q", buf, expect)
+	}
+}
+
+func TestRunFolder(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := filepath.Join(t.TempDir(), "script")
+	err = os.Mkdir(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	helper := "package main\n\nfunc helper() string {\n\treturn %q\n}\n"
+	writeFiles(map[string]string{
+		"main.go":   "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(helper())\n}\n",
+		"helper.go": fmt.Sprintf(helper, "one"),
+		"x_test.go": "package main\n\nthis is not compiled\n",
+	})
+	run := func(expect string) {
+		t.Helper()
+		buf, err := exec.Command(gorun, dir).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, buf)
+		}
+		if string(buf) != expect {
+			t.Fatalf("got %q but expected %q", buf, expect)
+		}
+	}
+	run("one\n")
+
+	// every file is part of the cache key
+	writeFiles(map[string]string{"helper.go": fmt.Sprintf(helper, "two")})
+	run("two\n")
+
+	// no main.go => which file is the script is unclear
+	os.Rename(filepath.Join(dir, "main.go"), filepath.Join(dir, "script.go"))
+	cmd := exec.Command(gorun, dir)
+	buf, _ := cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 3 || !strings.Contains(string(buf), "no main.go") {
+		t.Fatalf("expected error for folder without main.go, got %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+}
+
+func TestInterruptCompile(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	// stub toolchain that hangs in go mod init
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\nexec sleep 30\n"
+	err = os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(dir, "slow.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// exit code of a shell: 128+signal
+	for sig, exitCode := range map[os.Signal]int{os.Interrupt: 130, syscall.SIGTERM: 143} {
+		cacheHome := filepath.Join(t.TempDir(), "cache")
+		cmd := exec.Command(gorun, "-toolchain", stubGo, gofile)
+		cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+cacheHome)
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		cmd.Process.Signal(sig)
+		err = cmd.Wait()
+		if cmd.ProcessState.ExitCode() != exitCode {
+			t.Fatalf("%s: expected exit code %d, got %v", sig, exitCode, err)
+		}
+
+		// objdirs are folders inside item folders
+		matches, err := filepath.Glob(filepath.Join(cacheHome, "gorun", "v*", "data", "*", "*", "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				t.Fatalf("%s: partial objdir left behind: %s", sig, m)
+			}
+		}
+	}
+}
+
+func TestInterruptLockWait(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	// stub toolchain that hangs in go mod init
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\nexec sleep 30\n"
+	err = os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(dir, "slow.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "XDG_CACHE_HOME="+filepath.Join(dir, "cache"))
+
+	compiling := exec.Command(gorun, "-toolchain", stubGo, gofile)
+	compiling.Env = env
+	err = compiling.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		compiling.Process.Kill()
+		compiling.Wait()
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// waits for the lock of the compile above
+	cmd := exec.Command(gorun, "-toolchain", stubGo, gofile)
+	cmd.Env = env
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	cmd.Process.Signal(os.Interrupt)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("Ctrl-C did not stop the wait for the lock")
+	}
+	if cmd.ProcessState.ExitCode() != 130 {
+		t.Fatalf("expected exit code 130, got %v", err)
+	}
+}
+
+func TestStdinFile(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "echo.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nimport (\n\t\"io\"\n\t\"os\"\n)\n\nfunc main() {\n\tio.Copy(os.Stdout, os.Stdin)\n\tos.Exit(5)\n}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "input.txt")
+	err = os.WriteFile(input, []byte("line 1\nline 2\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gorun, "-stdin-file", input, gofile)
+	cmd.Stdin = strings.NewReader("not from file\n")
+	buf, err := cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 5 {
+		t.Fatalf("expected exit code 5, got %v\n%s", err, buf)
+	}
+	if string(buf) != "line 1\nline 2\n" {
+		t.Fatalf("got %q but expected the content of %s", buf, input)
+	}
+
+	buf, err = exec.Command(gorun, "-stdin-file", filepath.Join(dir, "missing.txt"), gofile).CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "missing.txt") {
+		t.Fatalf("expected error for missing file, got %v\n%s", err, buf)
+	}
+}
+
+func TestStdinPipe(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(t.TempDir(), "filter.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nimport (\n\t\"io\"\n\t\"os\"\n)\n\nfunc main() {\n\tio.Copy(os.Stdout, os.Stdin)\n}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a filter script must see our stdin: exec passes it on, on windows
+	// Exec forwards it to the program as a child process
+	cmd := exec.Command(gorun, gofile)
+	cmd.Stdin = strings.NewReader("piped 1\npiped 2\n")
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	if string(buf) != "piped 1\npiped 2\n" {
+		t.Fatalf("got %q but expected the piped input", buf)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	scripts := map[string]struct {
+		body string
+		code int
+	}{
+		"ok":    {"", 0},
+		"exit7": {"os.Exit(7)", 7},
+		"panic": {"panic(\"boom\")", 2},
+	}
+	for name, script := range scripts {
+		gofile := filepath.Join(dir, name+".go")
+		code := fmt.Sprintf("package main\n\nimport \"os\"\n\nvar _ = os.Exit\n\nfunc main() {\n\t%s\n}\n", script.body)
+		err := os.WriteFile(gofile, []byte(code), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// exec replaces gorun with the program, spawn runs it as a
+		// child process as on windows
+		for mode, args := range map[string][]string{
+			"exec":  {gofile},
+			"spawn": {"-stdin-file", os.DevNull, gofile},
+		} {
+			cmd := exec.Command(gorun, args...)
+			buf, _ := cmd.CombinedOutput()
+			if cmd.ProcessState.ExitCode() != script.code {
+				t.Errorf("%s %s: expected exit code %d, got %d\n%s", name, mode, script.code, cmd.ProcessState.ExitCode(), buf)
+			}
+		}
+	}
+}
+
+func TestPathIndependentKey(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	itemdir := func(gofile string, options ...string) string {
+		err := os.MkdirAll(filepath.Dir(gofile), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"same\") }\n"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := exec.Command(gorun, append(append([]string{"-show"}, options...), gofile)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, buf)
+		}
+		_, outdir, found := strings.Cut(string(buf), " cd ")
+		if !found {
+			t.Fatalf("no build folder in output:\n%s", buf)
+		}
+		outdir, _, _ = strings.Cut(outdir, "\n")
+		return filepath.Dir(outdir)
+	}
+	a := itemdir(filepath.Join(dir, "a", "script.go"))
+	b := itemdir(filepath.Join(dir, "b", "other", "copy.go"))
+	if a != b {
+		t.Fatalf("same content from two paths got two cache entries:\n%s\n%s", a, b)
+	}
+
+	a = itemdir(filepath.Join(dir, "a", "script.go"), "-path-key")
+	b = itemdir(filepath.Join(dir, "b", "other", "copy.go"), "-path-key")
+	if a == b {
+		t.Fatalf("-path-key: same content from two paths got one cache entry %s", a)
+	}
+}
+
+func TestStdinSameKey(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	code := "#! /usr/bin/env gorun\n\npackage main\n\nfunc main() { println(\"from file or stdin\") }\n"
+	gofile := filepath.Join(dir, "script.go")
+	err = os.WriteFile(gofile, []byte(code), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outdir := func(cmd *exec.Cmd) string {
+		t.Helper()
+		buf, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	fromFile := outdir(exec.Command(gorun, "-build-only", gofile))
+	cmd := exec.Command(gorun, "-build-only", "-")
+	cmd.Stdin = strings.NewReader(code)
+	fromStdin := outdir(cmd)
+	cmd = exec.Command(gorun, "-build-only", "script.go")
+	cmd.Dir = dir
+	fromRelative := outdir(cmd)
+	if fromFile != fromStdin || fromFile != fromRelative {
+		t.Fatalf("same source got different build folders:\nfile:     %sstdin:    %srelative: %s", fromFile, fromStdin, fromRelative)
+	}
+}
+
+func TestExamples(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+
+	buf, err := exec.Command(gorun, "-examples").CombinedOutput()
+	if err != nil || !strings.Contains(string(buf), "  hello ") {
+		t.Fatalf("expected hello in example list, got %v\n%s", err, buf)
+	}
+	buf, err = exec.Command(gorun, "-example", "hello").CombinedOutput()
+	if err != nil || string(buf) != "hello world from gorun\n" {
+		t.Fatalf("unexpected output of example hello: %v\n%s", err, buf)
+	}
+	buf, err = exec.Command(gorun, "-example", "args", "x", "y").CombinedOutput()
+	if err != nil || string(buf) != "1: x\n2: y\n" {
+		t.Fatalf("unexpected output of example args: %v\n%s", err, buf)
+	}
+	buf, err = exec.Command(gorun, "-example", "missing").CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "no example named") {
+		t.Fatalf("expected error for missing example, got %v\n%s", err, buf)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "tool.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"tool ran\") }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exefile := filepath.Join(dir, "tool")
+	buf, err := exec.Command(gorun, "-o", exefile, gofile).CombinedOutput()
+	if err != nil || len(buf) != 0 {
+		t.Fatalf("expected no output and no run, got %v\n%s", err, buf)
+	}
+	buf, err = exec.Command(exefile).CombinedOutput()
+	if err != nil || string(buf) != "tool ran\n" {
+		t.Fatalf("written executable failed: %v\n%s", err, buf)
+	}
+
+	buf, err = exec.Command(gorun, "-o", dir, gofile).CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "is a directory") {
+		t.Fatalf("expected error for directory, got %v\n%s", err, buf)
+	}
+	buf, err = exec.Command(gorun, "-o", filepath.Join(dir, "missing", "tool"), gofile).CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "failed to write") {
+		t.Fatalf("expected error for unwritable destination, got %v\n%s", err, buf)
+	}
+}
+
+func TestWasm(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "hello.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"hello browser\") }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := exec.Command(gorun, "--GOOS", "js", "--GOARCH", "wasm", gofile).CombinedOutput()
+	if err == nil || !strings.Contains(string(buf), "js/wasm executable can not run here") {
+		t.Fatalf("expected error without -o, got %v\n%s", err, buf)
+	}
+
+	wasmfile := filepath.Join(dir, "main.wasm")
+	buf, err = exec.Command(gorun, "--GOOS", "js", "--GOARCH", "wasm", "-o", wasmfile, gofile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	buf, err = os.ReadFile(wasmfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf, []byte("\x00asm")) {
+		t.Fatalf("no wasm magic header in %s: % x", wasmfile, buf[:min(len(buf), 8)])
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake release is a shell script")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	buf, err := os.ReadFile(filepath.Join(cwd, "gorun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorunCopy := filepath.Join(dir, "gorun")
+	err = os.WriteFile(gorunCopy, buf, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := []byte("#! /bin/sh\necho updated\n")
+	checksum := fmt.Sprintf("%x  gorun.%s-%s\n", sha256.Sum256(release), runtime.GOOS, runtime.GOARCH)
+	asset := fmt.Sprintf("/download/v99.0.0/gorun.%s-%s", runtime.GOOS, runtime.GOARCH)
+	var corrupt, older atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest":
+			if older.Load() {
+				http.Redirect(w, r, "/tag/v0.1.0", http.StatusFound)
+			} else {
+				http.Redirect(w, r, "/tag/v99.0.0", http.StatusFound)
+			}
+		case asset:
+			w.Write(release)
+		case asset + ".sha256":
+			if corrupt.Load() {
+				w.Write([]byte(strings.Repeat("0", 64) + "\n"))
+			} else {
+				w.Write([]byte(checksum))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command(gorunCopy, args...)
+		cmd.Env = append(os.Environ(), "GORUN_RELEASE_URL="+server.URL)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	out, err := run("-self-update")
+	if err != nil || !strings.Contains(out, "v99.0.0 is available") {
+		t.Fatalf("expected update available, got %v\n%s", err, out)
+	}
+	older.Store(true)
+	out, err = run("-self-update", "-yes")
+	if err != nil || !strings.Contains(out, "is up to date") {
+		t.Fatalf("expected no downgrade to v0.1.0, got %v\n%s", err, out)
+	}
+	older.Store(false)
+	out, err = run("-yes")
+	if err == nil {
+		t.Fatalf("expected -yes without -self-update to fail\n%s", out)
+	}
+
+	corrupt.Store(true)
+	out, err = run("-self-update", "-yes")
+	if err == nil || !strings.Contains(out, "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v\n%s", err, out)
+	}
+	corrupt.Store(false)
+	out, err = run("-self-update", "-yes")
+	if err != nil || !strings.Contains(out, "updated") {
+		t.Fatalf("self-update failed: %v\n%s", err, out)
+	}
+	newRelease, err := exec.Command(gorunCopy).CombinedOutput()
+	if err != nil || string(newRelease) != "updated\n" {
+		t.Fatalf("expected the new release to run, got %v\n%s", err, newRelease)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "trace.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceFile := filepath.Join(dir, "trace.json")
+	cmd := exec.Command(gorun, "-trace", traceFile, gofile)
+	cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+filepath.Join(dir, "cache")) // => compile
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+
+	buf, err = os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []struct {
+			Name string
+			Ph   string
+			Ts   int64
+			Dur  int64
+		}
+	}
+	err = json.Unmarshal(buf, &trace)
+	if err != nil {
+		t.Fatalf("trace is not JSON: %v\n%s", err, buf)
+	}
+	found := make(map[string]bool)
+	for _, e := range trace.TraceEvents {
+		found[e.Name] = true
+		if e.Ts == 0 || (e.Ph != "X" && e.Ph != "i") {
+			t.Fatalf("bad event %+v", e)
+		}
+	}
+	for _, name := range []string{"gorun", "cache key", "lock wait", "lookup", "compile", "go mod init", "go get", "go build", "exec"} {
+		if !found[name] {
+			t.Fatalf("no %q span in trace:\n%s", name, buf)
+		}
+	}
+}
+
+func TestTrimFreed(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-trim")
+	cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+t.TempDir())
+	buf, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(buf), "freed 0 items, 0 MB\n") {
+		t.Fatalf("expected freed summary, got %v\n%s", err, buf)
+	}
+}
+
+func TestCacheJSON(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-c", "-json")
+	cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+	buf, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stat struct {
+		Count         int
+		SizeBytes     int64
+		Dir           string
+		MaxAgeSeconds int64
+		MaxBytes      int64
+	}
+	err = json.Unmarshal(buf, &stat)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	if stat.Dir != filepath.Join(cacheHome, "gorun", fmt.Sprintf("v%d", cache.LayoutVersion)) || stat.MaxAgeSeconds != 10*24*3600 || stat.Count != 0 {
+		t.Fatalf("unexpected %+v", stat)
+	}
+
+	cmd = exec.Command(filepath.Join(cwd, "gorun"), "-json")
+	cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+cacheHome)
+	buf, _ = cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 3 {
+		t.Fatalf("expected -json without -c to fail, got %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+}
+
+func TestScriptURL(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "#! /usr/bin/env gorun\npackage main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"from url\") }\n"
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		if r.URL.Path != "/tool.go" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, script)
+	}))
+	defer server.Close()
+	cacheHome := t.TempDir()
+	run := func(url string, env ...string) (string, int) {
+		cmd := exec.Command(filepath.Join(cwd, "gorun"), url)
+		cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+		cmd.Env = append(cmd.Env, env...)
+		buf, _ := cmd.CombinedOutput()
+		return string(buf), cmd.ProcessState.ExitCode()
+	}
+
+	out, code := run(server.URL + "/tool.go")
+	if code != 3 || !strings.Contains(out, "needs GORUN_ALLOW_URL=1") || downloads.Load() != 0 {
+		t.Fatalf("expected URL refused, got exit code %d\n%s", code, out)
+	}
+	for i := 0; i < 2; i++ {
+		out, code = run(server.URL+"/tool.go", "GORUN_ALLOW_URL=1")
+		if code != 0 || out != "from url\n" {
+			t.Fatalf("expected script output, got exit code %d\n%s", code, out)
+		}
+	}
+	if downloads.Load() != 2 {
+		t.Fatalf("expected a download per run, got %d", downloads.Load())
+	}
+	out, code = run(server.URL+"/missing.go", "GORUN_ALLOW_URL=1")
+	if code != 3 || !strings.Contains(out, "404 Not Found") {
+		t.Fatalf("expected download error, got exit code %d\n%s", code, out)
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "fail.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nimport \"os\"\n\nfunc main() { os.Exit(4) }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := filepath.Join(dir, "tmp")
+	err = os.Mkdir(tmpDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-no-cache", "-tmpdir", tmpDir, gofile)
+	cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+	buf, _ := cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 4 {
+		t.Fatalf("expected exit code 4, got %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+	// removed also after a failed run, and the cache is not used
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected empty %s, got %d entries %v", tmpDir, len(entries), err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheHome, "gorun")); !os.IsNotExist(err) {
+		t.Fatalf("expected no cache in %s, got %v", cacheHome, err)
+	}
+}
+
+func TestVersionJSON(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-v", "-json")
+	cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+	buf, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version map[string]string
+	err = json.Unmarshal(buf, &version)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	expect := map[string]string{
+		"gorun":      gorun.GorunVersion(),
+		"gocompiler": gocompiler.GoVersion(),
+		"cacheDir":   filepath.Join(cacheHome, "gorun", fmt.Sprintf("v%d", cache.LayoutVersion)),
+	}
+	if !maps.Equal(version, expect) {
+		t.Fatalf("expected %v, got %v", expect, version)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(t.TempDir(), "sleep.go")
+	code := "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n\t\"time\"\n)\n\nfunc main() {\n\td, _ := time.ParseDuration(os.Args[1])\n\ttime.Sleep(d)\n\tfmt.Println(\"discarded\")\n}\n"
+	err = os.WriteFile(gofile, []byte(code), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-benchmark", "-n", "5", gofile, "50ms")
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	out := string(buf)
+	if !strings.HasPrefix(out, "5 runs: min ") || strings.Contains(out, "discarded") {
+		t.Fatalf("unexpected output %q", out)
+	}
+	_, after, _ := strings.Cut(out, "median ")
+	s, _, _ := strings.Cut(after, ",")
+	median, err := time.ParseDuration(s)
+	if err != nil {
+		t.Fatalf("no median in %q - %s", out, err)
+	}
+	if median < 50*time.Millisecond || median > 5*time.Second {
+		t.Fatalf("median %s out of range for a 50ms sleep", median)
+	}
+}
+
+func TestCaptureReplayEnv(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+	gofile := filepath.Join(dir, "broken.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nimport \"fmt\"\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := filepath.Join(dir, "env.json")
+	cmd := exec.Command(gorun, "-capture-env", capture, gofile)
+	buf, _ := cmd.CombinedOutput()
+	if cmd.ProcessState.ExitCode() != 17 {
+		t.Fatalf("expected compile error, got %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+
+	replay := func(expectCode int, expect ...string) {
+		t.Helper()
+		cmd := exec.Command(gorun, "-replay-env", capture)
+		buf, _ := cmd.CombinedOutput()
+		if cmd.ProcessState.ExitCode() != expectCode {
+			t.Fatalf("expected exit code %d, got %d\n%s", expectCode, cmd.ProcessState.ExitCode(), buf)
+		}
+		for _, s := range expect {
+			if !strings.Contains(string(buf), s) {
+				t.Fatalf("missing %q in\n%s", s, buf)
+			}
+		}
+	}
+	replay(0, "cache input is identical\n", `"fmt" imported and not used`, "captured: compile failed, here: compile failed, reproduced: true")
+
+	// as if captured with another gorun and fixed there
+	var env map[string]any
+	buf, err = os.ReadFile(capture)
+	if err == nil {
+		err = json.Unmarshal(buf, &env)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	env["CacheInput"] = strings.Replace(env["CacheInput"].(string), "// gorun: ", "// gorun: 0.0.1-", 1)
+	env["Error"] = ""
+	buf, err = json.Marshal(env)
+	if err == nil {
+		err = os.WriteFile(capture, buf, 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay(1, "cache input differs", "- // gorun: 0.0.1-", "+ // gorun: ", "reproduced: false")
+}
+
+func TestTrimMaxSize(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	run := func(args ...string) (string, int) {
+		cmd := exec.Command(filepath.Join(cwd, "gorun"), args...)
+		cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+cacheHome)
+		buf, _ := cmd.CombinedOutput()
+		return string(buf), cmd.ProcessState.ExitCode()
+	}
+	out, code := run("-trim", "-max-size", "1k", "-evict-policy", "lfu")
+	if code != 0 || !strings.Contains(out, "freed 0 items") {
+		t.Fatalf("expected trim with size limit, got exit code %d\n%s", code, out)
+	}
+	for _, args := range [][]string{
+		{"-trim", "-evict-policy", "lfu"},
+		{"-trim", "-max-size", "1k", "-evict-policy", "mru"},
+		{"-max-size", "1k"},
+	} {
+		out, code := run(args...)
+		if code != 3 {
+			t.Fatalf("%v: expected exit code 3, got %d\n%s", args, code, out)
+		}
+	}
+}
+
+func TestTrimFixPermissions(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	run := func(args ...string) (string, int) {
+		cmd := exec.Command(filepath.Join(cwd, "gorun"), args...)
+		cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+		buf, _ := cmd.CombinedOutput()
+		return string(buf), cmd.ProcessState.ExitCode()
+	}
+	out, code := run("-fix-permissions")
+	if code != 3 {
+		t.Fatalf("expected -fix-permissions without -trim to fail, got exit code %d\n%s", code, out)
+	}
+	out, code = run("-trim")
+	if code != 0 {
+		t.Fatalf("trim failed with exit code %d\n%s", code, out)
+	}
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		return // root can delete anything
+	}
+	// an item of this user that trim can not delete
+	itemdir := filepath.Join(cacheHome, "gorun", "v1", "data", "00-t", strings.Repeat("0", 40))
+	err = os.Mkdir(itemdir, 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(itemdir, 0700)
+	mode := func() fs.FileMode {
+		t.Helper()
+		info, err := os.Stat(itemdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+	out, code = run("-trim")
+	if code != 0 || !strings.Contains(out, "-fix-permissions") || mode() != 0500 {
+		t.Fatalf("expected trim to only report, got exit code %d mode %s\n%s", code, mode(), out)
+	}
+	out, code = run("-trim", "-fix-permissions")
+	if code != 0 || mode() != 0700 {
+		t.Fatalf("expected -fix-permissions to fix, got exit code %d mode %s\n%s", code, mode(), out)
+	}
+}
+
+func TestRace(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found in PATH")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(t.TempDir(), "racy.go")
+	code := "package main\n\nfunc main() {\n\tx := 0\n\tdone := make(chan bool)\n\tgo func() { x++; done <- true }()\n\tx++\n\t<-done\n}\n"
+	err = os.WriteFile(gofile, []byte(code), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(cwd, "gorun"), "-race", gofile)
+	cmd.Env = append(os.Environ(), "CC=gcc")
+	buf, _ := cmd.CombinedOutput()
+	// 66 = exit code of a program with a data race
+	if cmd.ProcessState.ExitCode() != 66 || !strings.Contains(string(buf), "WARNING: DATA RACE") {
+		t.Fatalf("expected data race, got exit code %d\n%s", cmd.ProcessState.ExitCode(), buf)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := t.TempDir()
+	run := func(args ...string) (string, int) {
+		cmd := exec.Command(filepath.Join(cwd, "gorun"), args...)
+		cmd.Env = append(os.Environ(), "GORUN_CACHE=", "XDG_CACHE_HOME="+cacheHome)
+		buf, _ := cmd.CombinedOutput()
+		return string(buf), cmd.ProcessState.ExitCode()
+	}
+	gofile := filepath.Join(t.TempDir(), "verify.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, code := run("-build-only", gofile)
+	if code != 0 {
+		t.Fatalf("build failed with exit code %d\n%s", code, out)
+	}
+	// as after a full disk
+	err = os.WriteFile(filepath.Join(strings.TrimSpace(out), "main"), nil, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, code = run("-verify")
+	if code != 1 || !strings.Contains(out, "verified 1 items, 1 broken, 0 deleted\n") {
+		t.Fatalf("expected broken item, got exit code %d\n%s", code, out)
+	}
+	out, code = run("-verify", "-repair")
+	if code != 0 || !strings.Contains(out, "1 broken, 1 deleted\n") {
+		t.Fatalf("expected repair, got exit code %d\n%s", code, out)
+	}
+	out, code = run("-verify")
+	if code != 0 || !strings.Contains(out, "verified 0 items, 0 broken") {
+		t.Fatalf("expected empty cache, got exit code %d\n%s", code, out)
+	}
+	out, code = run("-repair")
+	if code != 3 {
+		t.Fatalf("expected -repair without -verify to fail, got exit code %d\n%s", code, out)
+	}
+}
+
+func TestStrictExit(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	// stub toolchain, STUB_BUILD selects how go build behaves
+	stubGo := filepath.Join(dir, "go")
+	stub := `#! /bin/sh
+if [ "$1" = env ]; then echo go1.22.0; exit 0; fi
+if [ "$1" != build ]; then exit 0; fi
+case "$STUB_BUILD" in
+fail) echo "undefined: x" >&2; exit 1;;
+slow) exec sleep 30;;
+esac
+printf '#! /bin/sh\nexit 7\n' > main; chmod +x main
+`
+	err = os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(dir, "strict.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		env   []string
+		args  []string
+		code  int
+		plain int // exit code without -strict-exit
+	}{
+		{"usage", nil, []string{"-encoding"}, 2, 3},
+		{"compile", []string{"STUB_BUILD=fail"}, []string{gofile}, 10, 17},
+		{"cache", []string{"GORUN_CACHE=relative/cache"}, []string{gofile}, 11, 3},
+		{"timeout", []string{"STUB_BUILD=slow"}, []string{"-build-timeout", "200ms", gofile}, 12, 17},
+		{"program", nil, []string{gofile}, 7, 7},
+		{"other", nil, []string{filepath.Join(dir, "missing.go")}, 3, 3},
+	}
+	for i, tc := range tests {
+		for _, strict := range []bool{true, false} {
+			args := append([]string{"-toolchain", stubGo}, tc.args...)
+			expect := tc.plain
+			if strict {
+				args = append([]string{"-strict-exit"}, args...)
+				expect = tc.code
+			}
+			cmd := exec.Command(gorun, args...)
+			cmd.Env = append(os.Environ(), "GORUN_CACHE=", fmt.Sprintf("XDG_CACHE_HOME=%s/cache%d", dir, i))
+			cmd.Env = append(cmd.Env, tc.env...)
+			out, _ := cmd.CombinedOutput()
+			if code := cmd.ProcessState.ExitCode(); code != expect {
+				t.Errorf("%s strict=%v: expected exit code %d, got %d\n%s", tc.name, strict, expect, code, out)
+			}
+		}
+	}
+}
+
+func TestMaxBinarySize(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(tmpdir(t), "size.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() { println(\"max-binary-size\") }\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHome := filepath.Join(tmpdir(t), "cache")
+	run := func(size string) (string, error) {
+		cmd := exec.Command(gorun, "-max-binary-size", size, gofile)
+		cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+cacheHome)
+		buf, err := cmd.CombinedOutput()
+		return string(buf), err
+	}
+
+	out, err := run("1k")
+	if err == nil || !strings.Contains(out, "binary too large") {
+		t.Fatalf("expected binary too large, got %v\n%s", err, out)
+	}
+	out, err = run("1G")
+	if err != nil || out != "max-binary-size\n" {
+		t.Fatalf("expected program output, got %v\n%s", err, out)
+	}
+	out, err = run("1x")
+	if err == nil || !strings.Contains(out, `bad size "1x"`) {
+		t.Fatalf("expected bad size, got %v\n%s", err, out)
+	}
+}
+
+func TestRepl(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	gofile := filepath.Join(tmpdir(t), "funcs.go")
+	script := "package main\n\nfunc double(x int) int { return 2 * x }\n\nfunc hello() { println(\"hello\") }\n\nfunc main() { panic(\"not called\") }\n"
+	err = os.WriteFile(gofile, []byte(script), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(gorun, "-repl", gofile)
+	cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+filepath.Join(tmpdir(t), "cache"))
+	cmd.Stdin = strings.NewReader("double(21)\n\nfmt.Println(\"sum\", 1+double(1))\nhello()\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, stderr.String())
+	}
+	expect := "42\nsum 3\n"
+	if stdout.String() != expect || stderr.String() != "hello\n" {
+		t.Fatalf("got %q and stderr %q but expected %q", stdout.String(), stderr.String(), expect)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := tmpdir(t)
+	scripts := map[string]string{
+		"one.go": "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tfmt.Println(\"one\", os.Args[1:])\n}\n",
+		"two.go": "// gorun:env TWO=from-bundle\npackage main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tfmt.Println(\"two\", os.Getenv(\"TWO\"))\n}\n",
+	}
+	for name, content := range scripts {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundleFile := filepath.Join(dir, "out.gorunpack")
+	cmd := exec.Command(gorun, "-bundle", bundleFile, "one.go", "two.go")
+	cmd.Dir = dir
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf)
+	}
+	for name := range scripts {
+		os.Remove(filepath.Join(dir, name))
+	}
+
+	// run from a new cache => no compile
+	cacheHome := filepath.Join(dir, "cache")
+	run := func(bundleFile string, args ...string) (string, error) {
+		cmd := exec.Command(gorun, append([]string{"-run-bundle", bundleFile}, args...)...)
+		cmd.Env = append(os.Environ(), "XDG_CACHE_HOME="+cacheHome)
+		buf, err := cmd.CombinedOutput()
+		return string(buf), err
+	}
+	out, err := run(bundleFile, "one.go", "a", "b")
+	if err != nil || out != "one [a b]\n" {
+		t.Fatalf("got %v\n%s", err, out)
+	}
+	out, err = run(bundleFile, "/elsewhere/two.go")
+	if err != nil || out != "two from-bundle\n" {
+		t.Fatalf("got %v\n%s", err, out)
+	}
+
+	// binary names must not escape the bundle
+	evil := filepath.Join(dir, "evil.gorunpack")
+	f, err := os.Create(evil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("manifest.json")
+	fmt.Fprintf(w, `{"GOOS": %q, "GOARCH": %q, "Scripts": [{"Script": "one.go", "Binary": "../../evil"}]}`, runtime.GOOS, runtime.GOARCH)
+	zw.Close()
+	f.Close()
+	out, err = run(evil, "one.go")
+	if err == nil || !strings.Contains(out, "bad binary name") {
+		t.Fatalf("expected bad binary name, got %v\n%s", err, out)
+	}
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gorun := filepath.Join(cwd, "gorun")
+	dir := t.TempDir()
+
+	// stub toolchain with a slow go build that creates a shell script
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\nif [ \"$1\" = build ]; then sleep 2; printf '#! /bin/sh\\necho ran\\n' > main; chmod +x main; fi\n"
+	err = os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gofile := filepath.Join(dir, "wait.go")
+	err = os.WriteFile(gofile, []byte("package main\n\nfunc main() {}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "XDG_CACHE_HOME="+filepath.Join(dir, "cache"))
+
+	leader := exec.Command(gorun, "-toolchain", stubGo, gofile)
+	leader.Env = env
+	err = leader.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	who := func() string {
+		cmd := exec.Command(gorun, "-toolchain", stubGo, "-who", gofile)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("-who failed: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+	host, _ := os.Hostname()
+	expect := fmt.Sprintf("compile in progress by pid %d on %s\n", leader.Process.Pid, host)
+	if out := who(); out != expect {
+		t.Fatalf("got %q but expected %q", out, expect)
+	}
+
+	follower := func(wait string) (string, string, error) {
+		cmd := exec.Command(gorun, "-toolchain", stubGo, "-wait", wait, gofile)
+		cmd.Env = env
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		return stdout.String(), stderr.String(), err
+	}
+	_, stderr, err := follower("100ms")
+	if err == nil || !strings.Contains(stderr, "timeout waiting for lock") {
+		t.Fatalf("expected timeout, got %v\n%s", err, stderr)
+	}
+	stdout, stderr, err := follower("30s")
+	if err != nil || stdout != "ran\n" {
+		t.Fatalf("expected program to run, got %v\n%s%s", err, stdout, stderr)
+	}
+	expect = fmt.Sprintf("waiting for compile by pid %d\n", leader.Process.Pid)
+	if stderr != expect {
+		t.Fatalf("got %q but expected %q", stderr, expect)
+	}
+	leader.Wait()
+	if out := who(); out != "no compile in progress\n" {
+		t.Fatalf("got %q after compile", out)
+	}
+}
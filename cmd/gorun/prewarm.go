@@ -0,0 +1,209 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bir3/gorun"
+	"github.com/bir3/gorun/cache"
+)
+
+// hasGorunShebang is true if the first line of filename is a shebang
+// that runs gorun, e.g. #! /usr/bin/env gorun
+func hasGorunShebang(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return false
+	}
+	for _, field := range strings.Fields(line[2:]) {
+		if filepath.Base(field) == "gorun" {
+			return true
+		}
+	}
+	return false
+}
+
+// shebangScripts returns the absolute paths of the files in dir with a
+// gorun shebang
+func shebangScripts(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	var scripts []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		filename, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+		if err != nil || !hasGorunShebang(filename) {
+			continue
+		}
+		scripts = append(scripts, filename)
+	}
+	return scripts
+}
+
+// prewarmLedger records the progress of a prewarm in a file, one line
+// per script, so that an interrupted prewarm of many scripts can resume
+// without checking the scripts that are done. Failed scripts are
+// recorded too and compiled again on resume.
+//
+//	# gorun prewarm <dir>
+//	ok <script>
+//	failed <script>
+type prewarmLedger struct {
+	f    *os.File
+	done map[string]bool // ok in the ledger when resumed
+}
+
+// openLedger opens the ledger file of a prewarm of dir: a new ledger,
+// or with resume the ledger of an earlier prewarm of dir if any
+func openLedger(filename string, dir string, resume bool) (*prewarmLedger, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("# gorun prewarm %s", dir)
+	ledger := &prewarmLedger{done: make(map[string]bool)}
+	buf, err := os.ReadFile(filename)
+	if resume && err == nil {
+		lines := strings.Split(string(buf), "\n")
+		if lines[0] != header {
+			return nil, fmt.Errorf("ledger %s is not for a prewarm of %s", filename, dir)
+		}
+		for _, line := range lines[1:] {
+			status, script, _ := strings.Cut(line, " ")
+			ledger.done[script] = status == "ok"
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resume || err != nil {
+		flags |= os.O_TRUNC
+	}
+	ledger.f, err = os.OpenFile(filename, flags, 0666)
+	if err == nil && flags&os.O_TRUNC != 0 {
+		_, err = fmt.Fprintf(ledger.f, "%s\n", header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write ledger - %w", err)
+	}
+	return ledger, nil
+}
+
+// record appends the result of script, a nil ledger records nothing
+func (ledger *prewarmLedger) record(script string, ok bool) error {
+	if ledger == nil {
+		return nil
+	}
+	status := "failed"
+	if ok {
+		status = "ok"
+	}
+	_, err := fmt.Fprintf(ledger.f, "%s %s\n", status, script)
+	if err != nil {
+		return fmt.Errorf("failed to write ledger - %w", err)
+	}
+	return nil
+}
+
+// prewarmShebang compiles all scripts in dir with a gorun shebang
+// so that the first run is fast, with the settings of base, e.g. the
+// toolchain. With a ledger the scripts that are done are skipped and
+// each result is recorded. False if any compile failed.
+func prewarmShebang(dir string, base *gorun.RunInfo, ledger *prewarmLedger) bool {
+	scripts := shebangScripts(dir)
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+
+	built, cached, failed, skipped := 0, 0, 0, 0
+	for _, filename := range scripts {
+		if ledger != nil && ledger.done[filename] {
+			skipped++
+			fmt.Printf("done   %s\n", filename)
+			continue
+		}
+		s := readFileAndStrip(filename)
+		info := *base
+		info.ScriptDir = filepath.Dir(filename)
+		_, err = gorun.CompileStringInfo(c, &info, s, nil, scriptInput())
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n%s\n", filename, err)
+		case info.Compiled:
+			built++
+			fmt.Printf("built  %s\n", filename)
+		default:
+			cached++
+			fmt.Printf("cached %s\n", filename)
+		}
+		err = ledger.record(filename, err == nil)
+		if err != nil {
+			errExit(fmt.Sprintf("%s", err))
+		}
+	}
+	fmt.Printf("%d built, %d cached, %d failed", built, cached, failed)
+	if skipped > 0 {
+		fmt.Printf(", %d done before", skipped)
+	}
+	fmt.Printf("\n")
+	return failed == 0
+}
+
+// installDir prewarms the scripts in dir with a gorun shebang and, if
+// binDir is set, links each script into binDir without its .go suffix
+// so it is found in PATH. Running it again only reports what is done
+// already. A file in binDir that is not a link to the script is kept.
+// False if a compile or link failed.
+func installDir(dir string, binDir string, trace *gorun.Trace) bool {
+	ok := prewarmShebang(dir, &gorun.RunInfo{Trace: trace}, nil)
+	if binDir == "" {
+		return ok
+	}
+	linked, existing, failed := 0, 0, 0
+	for _, script := range shebangScripts(dir) {
+		link := filepath.Join(binDir, strings.TrimSuffix(filepath.Base(script), ".go"))
+		target, err := os.Readlink(link)
+		switch {
+		case err == nil && target == script:
+			existing++
+			fmt.Printf("exists %s\n", link)
+			continue
+		case err == nil:
+			err = fmt.Errorf("%s links to %s, not replaced", link, target)
+		case !os.IsNotExist(err):
+			if _, statErr := os.Lstat(link); statErr == nil {
+				err = fmt.Errorf("%s exists and is not a link, not replaced", link)
+			}
+		default:
+			err = os.Symlink(script, link)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			continue
+		}
+		linked++
+		fmt.Printf("linked %s -> %s\n", link, script)
+	}
+	fmt.Printf("%d linked, %d existed, %d failed\n", linked, existing, failed)
+	return ok && failed == 0
+}
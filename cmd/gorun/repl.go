@@ -0,0 +1,141 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"os"
+	"strings"
+
+	"github.com/bir3/gorun"
+	"github.com/bir3/gorun/cache"
+)
+
+// replFile is the generated file with main for a repl line
+const replFile = "gorun_repl.go"
+
+// replSources returns the script with main renamed and the source of
+// replFile that runs line: an expression is printed, except a call of
+// a function that is not a script function with results, as the call
+// may not return a value
+func replSources(s string, line string) (string, string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", s, parser.ParseComments)
+	if err != nil {
+		return "", "", err
+	}
+	hasResults := make(map[string]bool)
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+			if fn.Name.Name == "main" {
+				fn.Name.Name = "gorunScriptMain"
+			}
+			hasResults[fn.Name.Name] = fn.Type.Results != nil
+		}
+	}
+	var buf bytes.Buffer
+	err = format.Node(&buf, fset, f)
+	if err != nil {
+		return "", "", err
+	}
+
+	line = renameMain(line)
+	stmt := line
+	if expr, err := parser.ParseExpr(line); err == nil {
+		print := true
+		if call, isCall := expr.(*ast.CallExpr); isCall {
+			ident, isIdent := call.Fun.(*ast.Ident)
+			print = isIdent && hasResults[ident.Name]
+		}
+		if print {
+			stmt = fmt.Sprintf("fmt.Println(%s)", line)
+		}
+	}
+	repl := fmt.Sprintf("package main\n\nimport \"fmt\"\n\nvar _ = fmt.Println\n\nfunc main() {\n%s\n}\n", stmt)
+	return buf.String(), repl, nil
+}
+
+// renameMain replaces the identifier main in line so that it refers
+// to the renamed main of the script
+func renameMain(line string) string {
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(line))
+	sc.Init(file, []byte(line), nil, 0)
+	var out strings.Builder
+	last := 0
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.IDENT && lit == "main" {
+			offset := file.Offset(pos)
+			out.WriteString(line[last:offset])
+			out.WriteString("gorunScriptMain")
+			last = offset + len(lit)
+		}
+	}
+	out.WriteString(line[last:])
+	return out.String()
+}
+
+// repl compiles and runs each line from stdin together with the
+// functions of the script in s. Each line is a separate program:
+// variables do not survive to the next line. Each unique line is
+// cached like any other script.
+func repl(info *gorun.RunInfo, s string) {
+	c, err := cache.DefaultConfig()
+	if err != nil {
+		cacheErrExit(fmt.Sprintf("cache init failed: %s", err))
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+	defer devNull.Close()
+
+	fileinfo, err := os.Stdin.Stat()
+	interactive := err == nil && fileinfo.Mode()&os.ModeCharDevice != 0
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Fprintf(os.Stderr, "> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		script, replSource, err := replSources(s, line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			continue
+		}
+		lineInfo := *info
+		lineInfo.Files = map[string]string{replFile: replSource}
+		for name, content := range info.Files {
+			lineInfo.Files[name] = content
+		}
+		outdir, err := gorun.CompileStringInfo(c, &lineInfo, script, nil, scriptInput())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			continue
+		}
+		runChild(outdir, script, nil, devNull)
+	}
+	if err := scanner.Err(); err != nil {
+		errExit(fmt.Sprintf("%s", err))
+	}
+}
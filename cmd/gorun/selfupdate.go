@@ -0,0 +1,202 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bir3/gorun"
+)
+
+// releases are published as
+//
+//	<releaseURL>/latest                        => redirect to .../tag/v<version>
+//	<releaseURL>/download/v<version>/gorun.<goos>-<goarch>
+//	<releaseURL>/download/v<version>/gorun.<goos>-<goarch>.sha256
+//
+// GORUN_RELEASE_URL overrides releaseURL, e.g. for a mirror
+const releaseURL = "https://github.com/bir3/gorun/releases"
+
+var updateClient = &http.Client{
+	Timeout: 5 * time.Minute,
+	// the redirect of /latest names the tag => do not follow
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// latestRelease returns the tag of the latest release, e.g. v0.9.1
+func latestRelease(base string) (string, error) {
+	resp, err := updateClient.Get(base + "/latest")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	_, tag, found := strings.Cut(location, "/tag/")
+	if !found || tag == "" || strings.Contains(tag, "/") {
+		return "", fmt.Errorf("no release tag in redirect of %s/latest: %s %q", base, resp.Status, location)
+	}
+	return tag, nil
+}
+
+// compareVersions compares release tags like v0.9.1 or v1.0.0-rc1 and
+// returns -1, 0 or +1. A pre-release is older than its release.
+func compareVersions(a, b string) (int, error) {
+	va, prea, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, preb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case prea == preb:
+		return 0, nil
+	case prea == "":
+		return 1, nil
+	case preb == "":
+		return -1, nil
+	}
+	return strings.Compare(prea, preb), nil
+}
+
+// parseVersion splits v<major>.<minor>.<patch>[-<pre>]
+func parseVersion(tag string) ([3]int, string, error) {
+	var v [3]int
+	s, found := strings.CutPrefix(tag, "v")
+	if !found {
+		return v, "", fmt.Errorf("bad release version %q", tag)
+	}
+	s, pre, _ := strings.Cut(s, "-")
+	fields := strings.Split(s, ".")
+	if len(fields) != 3 {
+		return v, "", fmt.Errorf("bad release version %q", tag)
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return v, "", fmt.Errorf("bad release version %q", tag)
+		}
+		v[i] = n
+	}
+	return v, pre, nil
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// selfUpdate replaces the running gorun with the latest release;
+// without yes it only reports if an update is available
+func selfUpdate(yes bool) error {
+	base := releaseURL
+	if s := os.Getenv("GORUN_RELEASE_URL"); s != "" {
+		base = strings.TrimSuffix(s, "/")
+	}
+	tag, err := latestRelease(base)
+	if err != nil {
+		return err
+	}
+	current := "v" + gorun.GorunVersion()
+	cmp, err := compareVersions(tag, current)
+	if err != nil {
+		return err
+	}
+	if cmp <= 0 { // never downgrade, e.g. a build from main
+		fmt.Printf("gorun %s is up to date, the latest release is %s\n", current, tag)
+		return nil
+	}
+	if !yes {
+		fmt.Printf("gorun %s is available, this is %s\nrun gorun -self-update -yes to install it\n", tag, current)
+		return nil
+	}
+
+	asset := fmt.Sprintf("%s/download/%s/gorun.%s-%s", base, tag, runtime.GOOS, runtime.GOARCH)
+	buf, err := download(asset)
+	if err != nil {
+		return err
+	}
+	sum, err := download(asset + ".sha256")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(sum)) // "<hex>" or "<hex>  <filename>"
+	if len(fields) == 0 || fields[0] != fmt.Sprintf("%x", sha256.Sum256(buf)) {
+		return fmt.Errorf("checksum mismatch for %s", asset)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+	err = replaceExecutable(exe, buf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("updated %s from %s to %s\n", exe, current, tag)
+	return nil
+}
+
+// replaceExecutable writes buf next to exe and renames it into place
+// - the running executable can not be written, but can be replaced
+// - windows can not replace a running executable, only rename it
+func replaceExecutable(exe string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".gorun-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to write next to %s - %w", exe, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+	_, err = io.Copy(tmp, bytes.NewReader(buf))
+	if err == nil {
+		err = tmp.Chmod(0755)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write next to %s - %w", exe, err)
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		err = os.Rename(exe, old)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), exe)
+}
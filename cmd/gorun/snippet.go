@@ -0,0 +1,175 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// snippetImports are the packages a snippet of -e can use without
+// importing them
+var snippetImports = []string{"fmt", "os", "strings"}
+
+// snippetSource returns the program of a snippet of -e: a snippet with
+// package main is a program already, else it is the body of main with
+// the snippetImports that it uses. The program is the cache key, so the
+// same snippet is compiled once.
+func snippetSource(snippet string) string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", snippet, parser.PackageClauseOnly)
+	if err == nil && f.Name.Name == "main" {
+		return snippet
+	}
+	used := usedPackages(snippet)
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	for _, pkg := range snippetImports {
+		if used[pkg] {
+			fmt.Fprintf(&b, "import %q\n", pkg)
+		}
+	}
+	fmt.Fprintf(&b, "\nfunc main() {\n%s\n}\n", snippet)
+	return b.String()
+}
+
+// usedPackages returns the identifiers in code that are followed by a
+// period, e.g. fmt in fmt.Println
+func usedPackages(code string) map[string]bool {
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(code))
+	sc.Init(file, []byte(code), nil, 0)
+	used := make(map[string]bool)
+	lastIdent := ""
+	for {
+		_, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.PERIOD && lastIdent != "" {
+			used[lastIdent] = true
+		}
+		lastIdent = ""
+		if tok == token.IDENT {
+			lastIdent = lit
+		}
+	}
+	return used
+}
+
+var reMainDecl = regexp.MustCompile(`^func\s+main\s*\(`)
+
+// wrapSource returns src as a program if it has no package clause, for
+// -wrap: the top-level import, func, var, const and type declarations
+// stay at package level and the other statements become the body of
+// main, with the snippetImports that src uses but does not import.
+// The program is the cache key.
+//
+// Statements are told apart by their first token only, so a statement
+// that starts with func, e.g. a called func literal, is taken for a
+// declaration, and var and const are package-level: they are set before
+// main runs, not in order with the statements. Compile errors refer to
+// the lines of the program, see -show.
+func wrapSource(src string) (string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly)
+	if err == nil && f.Name != nil {
+		return src, nil
+	}
+
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var scanErr error
+	sc.Init(file, []byte(src), func(pos token.Position, msg string) {
+		if scanErr == nil {
+			scanErr = fmt.Errorf("line %d: %s", pos.Line, msg)
+		}
+	}, 0)
+	var imports, decls, stmts []string
+	depth := 0
+	start := -1 // offset of the first token of the statement
+	var first token.Token
+	for {
+		pos, tok, _ := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		offset := file.Offset(pos)
+		if start < 0 {
+			if tok == token.SEMICOLON {
+				continue
+			}
+			start, first = offset, tok
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACE, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACK:
+			depth--
+		case token.SEMICOLON:
+			if depth > 0 {
+				continue
+			}
+			chunk := src[start:offset]
+			switch first {
+			case token.IMPORT:
+				imports = append(imports, chunk)
+			case token.FUNC, token.VAR, token.CONST, token.TYPE:
+				decls = append(decls, chunk)
+			default:
+				stmts = append(stmts, chunk)
+			}
+			start = -1
+		}
+	}
+	if scanErr != nil {
+		return "", scanErr
+	}
+	if start >= 0 {
+		// unbalanced, left for the compiler to report
+		stmts = append(stmts, src[start:])
+	}
+
+	imported := make(map[string]bool)
+	importFile, err := parser.ParseFile(token.NewFileSet(), "", "package main\n"+strings.Join(imports, "\n"), parser.ImportsOnly)
+	if err != nil {
+		return "", err
+	}
+	for _, spec := range importFile.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imported[name] = true
+	}
+	used := usedPackages(src)
+	for _, pkg := range snippetImports {
+		if used[pkg] && !imported[pkg] {
+			imports = append(imports, fmt.Sprintf("import %q", pkg))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("package main\n\n")
+	for _, imp := range imports {
+		fmt.Fprintf(&b, "%s\n", imp)
+	}
+	hasMain := false
+	for _, decl := range decls {
+		fmt.Fprintf(&b, "\n%s\n", decl)
+		hasMain = hasMain || reMainDecl.MatchString(decl)
+	}
+	if len(stmts) > 0 || !hasMain {
+		fmt.Fprintf(&b, "\nfunc main() {\n%s\n}\n", strings.Join(stmts, "\n"))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxScriptSize is the largest script that fetchScript downloads
+const maxScriptSize = 10 << 20
+
+var scriptClient = &http.Client{Timeout: 30 * time.Second}
+
+// isScriptURL is true if filename is an http or https URL
+func isScriptURL(filename string) bool {
+	return strings.HasPrefix(filename, "https://") || strings.HasPrefix(filename, "http://")
+}
+
+// scriptURLName returns the name of the script at rawURL, e.g. tool.go,
+// for the by-name links of the cache
+func scriptURLName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+// fetchScript downloads the script at rawURL, only with GORUN_ALLOW_URL=1
+// as the script then runs with the rights of the user. The script is
+// downloaded on every run, the executable is cached per content.
+func fetchScript(rawURL string) (string, error) {
+	if os.Getenv("GORUN_ALLOW_URL") != "1" {
+		return "", fmt.Errorf("running a script from a URL needs GORUN_ALLOW_URL=1")
+	}
+	resp, err := scriptClient.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s failed: %s", rawURL, resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, maxScriptSize+1))
+	if err != nil {
+		return "", fmt.Errorf("download %s failed - %w", rawURL, err)
+	}
+	if len(buf) > maxScriptSize {
+		return "", fmt.Errorf("download %s failed: larger than %d MB", rawURL, maxScriptSize>>20)
+	}
+	return string(buf), nil
+}
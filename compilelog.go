@@ -0,0 +1,54 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// compileLogEnv names a file that gets a JSON line per compile, e.g. to
+// find out why the startup of a script is slow across many runs:
+//
+//	{"Time":"...","Hit":true,"Seconds":0.002,"Outdir":"..."}
+const compileLogEnv = "GORUN_COMPILE_LOG"
+
+type compileLogEntry struct {
+	Time    time.Time
+	Hit     bool    // found in the cache, no compile
+	Seconds float64 // cache key, lookup and compile
+	Outdir  string
+	Error   string `json:",omitempty"`
+}
+
+// logCompile appends the result of a compile that started at start to
+// the file of compileLogEnv, if set. Errors are ignored: the log is
+// informational.
+func logCompile(start time.Time, compiled bool, outdir string, err error) {
+	logfile := os.Getenv(compileLogEnv)
+	if logfile == "" {
+		return
+	}
+	entry := compileLogEntry{
+		Time:    start,
+		Hit:     !compiled && err == nil,
+		Seconds: time.Since(start).Seconds(),
+		Outdir:  outdir,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	buf, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return
+	}
+	f, openErr := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if openErr != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(buf, '\n')) // one write => lines of processes do not mix
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"fmt"
+	"go/version"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Directives are settings in the leading comment block of a script,
+// before the package clause:
+//
+//	// gorun:flags -tags netgo          extra go build flags
+//	// gorun:build -ldflags "-s -w"     same as gorun:flags
+//	// gorun:require example.com/m v1.2.3
+//	// gorun:lang 1.21                  go version of go.mod
+//	// gorun:min-go 1.21                fail early with an older toolchain
+//	// gorun:go 1.21                    same as lang and min-go
+//	// gorun:args -v                    arguments before the program arguments
+//	// gorun:env KEY=value              environment, unless KEY is already set
+//	// gorun:embed ./assets/...         files next to the script for go:embed
+//
+// flags, require, lang, min-go and go affect the build and are part of the cache key
+// as the source is part of the key, embed also with the content of the files.
+// args and env only affect the run.
+type Directives struct {
+	Flags   []string
+	Require []string // module@version
+	Lang    string
+	MinGo   string // e.g. 1.21
+	Args    []string
+	Env     []string
+	Embed   []string // patterns relative to the script folder
+}
+
+// ParseDirectives parses the leading comment block of goCode
+func ParseDirectives(goCode string) (Directives, error) {
+	var d Directives
+	lines := strings.Split(goCode, "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#!") {
+		lines = lines[1:]
+	}
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break // end of leading comment block
+		}
+		line = strings.TrimSpace(line[2:])
+		name, value, found := strings.Cut(line, " ")
+		if !strings.HasPrefix(name, "gorun:") {
+			continue // normal comment
+		}
+		value = strings.TrimSpace(value)
+		fields, err := splitQuoted(value)
+		if err == nil && !found {
+			err = fmt.Errorf("missing value")
+		}
+		if err == nil {
+			switch name {
+			case "gorun:flags", "gorun:build":
+				d.Flags = append(d.Flags, fields...)
+			case "gorun:require":
+				if len(fields) != 2 {
+					err = fmt.Errorf("expected module and version")
+				} else {
+					d.Require = append(d.Require, fields[0]+"@"+fields[1])
+				}
+			case "gorun:lang":
+				d.Lang = strings.TrimPrefix(value, "go")
+			case "gorun:min-go":
+				d.MinGo = strings.TrimPrefix(value, "go")
+				if !version.IsValid("go" + d.MinGo) {
+					err = fmt.Errorf("bad go version %q", value)
+				}
+			case "gorun:go":
+				d.MinGo = strings.TrimPrefix(value, "go")
+				d.Lang = d.MinGo
+				if !version.IsValid("go" + d.MinGo) {
+					err = fmt.Errorf("bad go version %q", value)
+				}
+			case "gorun:args":
+				d.Args = append(d.Args, fields...)
+			case "gorun:env":
+				for _, kv := range fields {
+					if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+						err = fmt.Errorf("expected KEY=value, got %q", kv)
+					}
+				}
+				d.Env = append(d.Env, fields...)
+			case "gorun:embed":
+				d.Embed = append(d.Embed, fields...)
+			default:
+				err = fmt.Errorf("unknown directive")
+			}
+		}
+		if err != nil {
+			return Directives{}, fmt.Errorf("line %d: %s - %w", i+1, name, err)
+		}
+	}
+	return d, nil
+}
+
+// splitQuoted splits s on whitespace, keeping quoted parts together
+// e.g. -ldflags "-s -w" => [-ldflags, -s -w]
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	var quote rune
+	for _, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inField = c, true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unbalanced quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+// Environ returns env with the env directives added,
+// variables already in env are not changed
+func (d Directives) Environ(env []string) []string {
+	out := append([]string(nil), env...)
+	for _, kv := range d.Env {
+		k, _, _ := strings.Cut(kv, "=")
+		if !hasEnv(env, k) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// command returns the command to run exefile with directives applied
+func (d Directives) command(exefile string, args []string) *exec.Cmd {
+	args = append(append([]string(nil), d.Args...), args...)
+	cmd := exec.Command(exefile, args...)
+	cmd.Env = d.Environ(os.Environ())
+	return cmd
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readEmbeds reads the files of the gorun:embed directives of goCode
+// from info.ScriptDir, by slash separated path relative to it. A pattern
+// is a file, a glob like *.txt or a folder with all files below it, e.g.
+// ./assets/... The files are copied to the build folder for go:embed and
+// their content is part of the cache key.
+func readEmbeds(info *RunInfo, goCode string) (map[string][]byte, error) {
+	d, err := ParseDirectives(goCode)
+	if err != nil || len(d.Embed) == 0 {
+		return nil, err
+	}
+	if info.ScriptDir == "" {
+		return nil, fmt.Errorf("gorun:embed needs the folder of the script, see RunInfo.ScriptDir")
+	}
+	embeds := make(map[string][]byte)
+	for _, pattern := range d.Embed {
+		names, err := embedNames(info.ScriptDir, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("gorun:embed %s - %w", pattern, err)
+		}
+		for _, name := range names {
+			buf, err := os.ReadFile(filepath.Join(info.ScriptDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("gorun:embed %s - %w", pattern, err)
+			}
+			embeds[filepath.ToSlash(name)] = buf
+		}
+	}
+	return embeds, nil
+}
+
+// embedNames returns the files of pattern in dir, relative to dir
+func embedNames(dir string, pattern string) ([]string, error) {
+	recursive := strings.HasSuffix(pattern, "/...")
+	pattern = filepath.Clean(filepath.FromSlash(strings.TrimSuffix(pattern, "/...")))
+	if !filepath.IsLocal(pattern) {
+		return nil, fmt.Errorf("outside the folder of the script")
+	}
+	var names []string
+	if recursive {
+		err := filepath.WalkDir(filepath.Join(dir, pattern), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return err
+			}
+			name, err := filepath.Rel(dir, path)
+			names = append(names, name)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			fileinfo, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !fileinfo.Mode().IsRegular() {
+				continue
+			}
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no such file")
+	}
+	for _, name := range names {
+		if filepath.Dir(name) == "." && (strings.HasSuffix(name, ".go") || name == "go.mod" || name == "go.sum") {
+			return nil, fmt.Errorf("%s would be part of the build, not embedded", name)
+		}
+	}
+	return names, nil
+}
+
+// writeEmbeds writes the files of readEmbeds to dir
+func writeEmbeds(dir string, embeds map[string][]byte) error {
+	for name, content := range embeds {
+		f := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(f), 0777)
+		if err == nil {
+			err = os.WriteFile(f, content, 0666)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s - %w", f, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/bir3/gorun"
+	"github.com/bir3/gorun/cache"
+)
+
+const helloCode = `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Printf("hello %s\n", os.Args[1])
+	os.Exit(3)
+}
+`
+
+func exampleConfig() (*cache.Config, func()) {
+	dir, err := os.MkdirTemp("", "gorun-example")
+	if err != nil {
+		panic(err)
+	}
+	config, err := cache.NewConfig(dir, 10*24*time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func ExampleCompileString() {
+	config, cleanup := exampleConfig()
+	defer cleanup()
+
+	outdir, err := gorun.CompileString(config, helloCode, nil, "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// the executable is "main" in outdir
+	out, err := exec.Command(filepath.Join(outdir, "main"), "world").Output()
+	fmt.Printf("%s%s\n", out, err)
+	// Output:
+	// hello world
+	// exit status 3
+}
+
+func ExampleRunScript() {
+	config, cleanup := exampleConfig()
+	defer cleanup()
+
+	exitCode, err := gorun.RunScript(config, helloCode, []string{"gopher"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("exit code %d\n", exitCode)
+	// Output:
+	// hello gopher
+	// exit code 3
+}
@@ -1,8 +1,11 @@
+//go:build !windows
+
 package gorun
 
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"syscall"
 )
 
@@ -15,3 +18,14 @@ func Exec(exefile string, args []string) error {
 	}
 	return nil // unreachable ! (exec should not return on success)
 }
+
+// ExitStatus returns the exit code of a program that failed with exitErr,
+// or 128+signal if a signal killed it, as a shell reports it, e.g. 139
+// for SIGSEGV. Exec needs no such mapping: the program replaces gorun,
+// so the parent sees the signal death itself.
+func ExitStatus(exitErr *exec.ExitError) int {
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
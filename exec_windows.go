@@ -1,6 +1,7 @@
 package gorun
 
 import (
+	"errors"
 	"os"
 	"os/exec"
 )
@@ -12,10 +13,20 @@ func Exec(exefile string, args []string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
-	// try to simulate exec on windows...
+	// simulate exec on windows: the exit code of the program is ours
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(ExitStatus(exitErr))
+	}
 	if err != nil {
-		os.Exit(1)
+		return err // e.g. not found, caller reports it
 	}
 	os.Exit(0)
+	return nil // unreachable
+}
 
+// ExitStatus returns the exit code of a program that failed with exitErr,
+// windows has no signal deaths to map
+func ExitStatus(exitErr *exec.ExitError) int {
+	return exitErr.ExitCode()
 }
@@ -2,7 +2,10 @@ module github.com/bir3/gorun
 
 go 1.22
 
-require github.com/bir3/gocompiler v0.9.2202
+require (
+	github.com/bir3/gocompiler v0.9.2202
+	golang.org/x/text v0.14.0
+)
 
 retract (
 	v0.8.0 // cgo not working
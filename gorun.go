@@ -6,10 +6,20 @@ package gorun
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"go/version"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bir3/gocompiler"
 	"github.com/bir3/gorun/cache"
@@ -19,23 +29,247 @@ func GorunVersion() string {
 	return "0.9.0"
 }
 
+// CompileError is a failed go command of a compile. Stdout and Stderr
+// are its output, e.g. the compiler diagnostics, and Dir and Cmdline
+// show how to repeat it.
 type CompileError struct {
-	Stdout string
-	Stderr string
-	Err    error
+	Stdout  string
+	Stderr  string
+	Err     error
+	Dir     string
+	Cmdline string // e.g. go build main.go
 }
 
 func (c *CompileError) Error() string {
-	return fmt.Sprintf("%s%s\nERROR: %s\n", c.Stdout, c.Stderr, c.Err)
+	return fmt.Sprintf("# cd %s\n# %s\n%s%s\nERROR: %s\n", c.Dir, c.Cmdline, c.Stdout, c.Stderr, c.Err)
 }
 
-func compile(c *cache.Config, srcfile string, exefile string) error {
+// CacheError is an error of the cache rather than of the script,
+// e.g. a lock or permission problem
+type CacheError struct {
+	Err error
+}
+
+func (c *CacheError) Error() string {
+	return c.Err.Error()
+}
+
+func (c *CacheError) Unwrap() error {
+	return c.Err
+}
+
+// RunInfo holds optional settings for CompileStringInfo
+type RunInfo struct {
+	BuildFlags []string // extra go build flags, part of the cache key
+
+	// Files are extra source files of the main package by name, written
+	// next to main.go, part of the cache key
+	Files map[string]string
+
+	// Toolchain selects the go command: "embedded" (default), a path to
+	// a go executable or a version like go1.21.5 found in PATH
+	Toolchain string
+
+	// CompileOutput, if set, receives each line of toolchain output as it
+	// is produced, e.g. for an IDE. Output is also kept for CompileError.
+	CompileOutput func(line string, isStderr bool)
+
+	// Debug compiles with optimizations and inlining disabled so the
+	// program can be debugged with e.g. delve. The executable is larger
+	// and slower and, without -trimpath, has the source paths for the
+	// debugger. Part of the cache key.
+	Debug bool
+
+	// Race builds with the race detector, which needs cgo: the build
+	// sets CGO_ENABLED=1 and fails early without a C compiler.
+	// Part of the cache key.
+	Race bool
+
+	// Vet runs go vet after the build and fails the compile with a
+	// CompileError if vet reports issues. Part of the cache key.
+	// Needs an external Toolchain as vet is not embedded: with the
+	// embedded toolchain the compile fails before the build.
+	Vet bool
+
+	// Trace, if set, records the time of each step: cache key, lock
+	// wait, compile and each go command
+	Trace *Trace
+
+	// HashOnlySource keys the cache on the source, files, build flags
+	// and debug only, not on the gocompiler, toolchain and gorun versions
+	// or environment variables. Fewer misses on a cache shared by
+	// identical environments, but the user must ensure that the
+	// environments really are identical or a wrong executable is used.
+	HashOnlySource bool
+
+	// MaxBinarySize, if not zero, is the maximum size in bytes of the
+	// executable, checked after go build. A larger executable is removed
+	// from the cache and the compile fails with ErrBinaryTooLarge.
+	MaxBinarySize int64
+
+	// GetTimeout and BuildTimeout, if not zero, limit the duration of
+	// go get (network) and go build (cpu) respectively
+	GetTimeout   time.Duration
+	BuildTimeout time.Duration
+
+	// Wait, if not zero, is how long to wait for another process that
+	// compiles the same script before failing with cache.ErrWaitTimeout.
+	// Waiting, if set, is then called once with the pid of the process.
+	Wait    time.Duration
+	Waiting func(pid int)
+
+	// Isolated compiles with new, empty GOCACHE, GOMODCACHE and GOPATH
+	// folders that are removed afterwards, so no host state influences
+	// the build. This is slow as everything is downloaded and compiled
+	// again. Not part of the cache key as the output is the same.
+	Isolated bool
+
+	// TempDir, if set, is the TMPDIR of the toolchain for its scratch
+	// files, e.g. when the default TMPDIR is a small tmpfs. Not part of
+	// the cache key as the output is the same.
+	TempDir string
+
+	// Name, if set, is the name of the script, e.g. tool.go, for a link
+	// to the build folder in the by-name folder of the cache, see
+	// cache.Config.Link. Not part of the cache key.
+	Name string
+
+	// ScriptDir is the folder of the script for the files of gorun:embed
+	// directives. Not part of the cache key, the content of the files is.
+	ScriptDir string
+
+	// SourcePath, if set, is the absolute path or URL of the script and
+	// part of the cache key: scripts with the same content at different
+	// paths then get their own executable, e.g. for a path-sensitive build.
+	// By default the same content shares an executable.
+	SourcePath string
+
+	// GOOS and GOARCH, if set, cross-compile for another target, e.g.
+	// js and wasm for the browser. The executable then usually cannot
+	// run here, see ExeName. Part of the cache key.
+	GOOS   string
+	GOARCH string
+
+	// AfterRun, if set, is called by RunScriptInfo after the program
+	// exits. Not called when gorun replaces itself with the program
+	// as then no gorun code runs afterwards.
+	AfterRun func(exitCode int, duration time.Duration)
+
+	Compiled bool // set by CompileStringInfo if no cached item was found
+}
+
+// ExeName is the name of the executable in the build folder: main, or
+// main.wasm for GOARCH wasm
+func (info *RunInfo) ExeName() string {
+	if info.GOARCH == "wasm" {
+		return "main.wasm"
+	}
+	return "main"
+}
+
+// ErrBinaryTooLarge is returned when the executable exceeds RunInfo.MaxBinarySize
+var ErrBinaryTooLarge = errors.New("binary too large")
+
+// lineWriter calls f for each complete line written
+type lineWriter struct {
+	mu       *sync.Mutex
+	f        func(line string, isStderr bool)
+	isStderr bool
+	partial  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.f(string(w.partial[:i]), w.isStderr)
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush sends a last line without newline
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.f(string(w.partial), w.isStderr)
+		w.partial = nil
+	}
+}
+
+// runContext runs cmd and kills it if ctx is cancelled
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.WaitDelay = time.Second // do not wait for orphaned grandchildren
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// compile builds srcfile into exefile; dryRun stops before go build
+// - if ctx is cancelled, the running toolchain process is killed
+func compile(ctx context.Context, c *cache.Config, info *RunInfo, d Directives, srcfile string, exefile string, dryRun bool) error {
+	tc, err := resolveToolchain(info.Toolchain)
+	if err != nil {
+		return err
+	}
+
+	env := os.Environ()
+	if info.TempDir != "" {
+		env = append(env, "TMPDIR="+info.TempDir, "TMP="+info.TempDir)
+	}
+	if info.GOOS != "" {
+		env = append(env, "GOOS="+info.GOOS)
+	}
+	if info.GOARCH != "" {
+		env = append(env, "GOARCH="+info.GOARCH)
+	}
+	if info.Race {
+		env = append(env, "CGO_ENABLED=1")
+		err = checkRace(env)
+		if err != nil {
+			return err
+		}
+	}
+	if info.Isolated {
+		dir, err := os.MkdirTemp(info.TempDir, "gorun-isolated")
+		if err != nil {
+			return fmt.Errorf("failed to create isolated go folders - %w", err)
+		}
+		defer os.RemoveAll(dir)
+		env = isolatedEnv(env, dir)
+	}
+
+	timeouts := map[string]time.Duration{"get": info.GetTimeout, "build": info.BuildTimeout}
 
 	runIf := func(err error, args []string) error {
 		if err != nil {
 			return err
 		}
-		cmd, err := gocompiler.Command(os.Environ(), args...)
+		stepCtx := ctx
+		timeout := timeouts[args[1]]
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			stepCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		cmd, err := tc.command(env, args...)
 		if err != nil {
 			return fmt.Errorf("failed to create exec.Cmd object - %w", err)
 		}
@@ -43,73 +277,565 @@ func compile(c *cache.Config, srcfile string, exefile string) error {
 
 		var out, outerr bytes.Buffer
 		cmd.Stdout, cmd.Stderr = &out, &outerr
+		if info.CompileOutput != nil {
+			var mu sync.Mutex // callback is never called concurrently
+			stdout := &lineWriter{mu: &mu, f: info.CompileOutput, isStderr: false}
+			stderr := &lineWriter{mu: &mu, f: info.CompileOutput, isStderr: true}
+			defer stdout.flush()
+			defer stderr.flush()
+			cmd.Stdout = io.MultiWriter(&out, stdout)
+			cmd.Stderr = io.MultiWriter(&outerr, stderr)
+		}
 
-		err = cmd.Run()
+		stepStart := time.Now()
+		err = runContext(stepCtx, cmd)
+		step := "go " + args[1]
+		if args[1] == "mod" && len(args) > 2 {
+			step += " " + args[2]
+		}
+		info.Trace.Span(step, stepStart)
+		if ctx.Err() != nil {
+			return fmt.Errorf("compile interrupted - %w", ctx.Err())
+		}
+		if stepCtx.Err() != nil {
+			return fmt.Errorf("go %s timed out after %s - %w", args[1], timeout, stepCtx.Err())
+		}
 
 		if err != nil {
-			var err error = &CompileError{out.String(), outerr.String(), err}
-			cmdline := strings.Join(args, " ")
-			return fmt.Errorf("# cd %s\n# %s\n%w", cmd.Dir, cmdline, err)
+			return &CompileError{
+				Stdout:  out.String(),
+				Stderr:  outerr.String(),
+				Err:     err,
+				Dir:     cmd.Dir,
+				Cmdline: strings.Join(args, " "),
+			}
 		}
 		return nil
 	}
-	var err error
 
 	err = runIf(err, []string{"go", "mod", "init", "main"})
+	// go.mod must match the compiler, not the go version that built gorun
+	lang := strings.TrimPrefix(tc.version, "go")
+	if d.Lang != "" {
+		lang = d.Lang
+	}
+	err = runIf(err, []string{"go", "mod", "edit", "-go=" + lang})
+	for _, require := range d.Require {
+		err = runIf(err, []string{"go", "mod", "edit", "-require=" + require})
+	}
 
 	err = runIf(err, []string{"go", "get"})
-	err = runIf(err, []string{"go", "build", "main.go"})
+	if dryRun {
+		return err
+	}
+	buildArgs := []string{"go", "build"}
+	if !info.Debug {
+		// the random build folder must not end up in the executable:
+		// the same source is then the same executable on any machine
+		buildArgs = append(buildArgs, "-trimpath")
+	}
+	// command line flags after directive flags => command line wins
+	buildArgs = append(buildArgs, d.Flags...)
+	if info.Debug {
+		buildArgs = append(buildArgs, "-gcflags", "all=-N -l")
+	}
+	if info.Race {
+		buildArgs = append(buildArgs, "-race")
+	}
+	buildArgs = append(buildArgs, info.BuildFlags...)
+	exeName := filepath.Base(exefile)
+	if len(info.Files) > 0 {
+		buildArgs = append(buildArgs, "-o", exeName, ".")
+	} else if exeName != "main" {
+		buildArgs = append(buildArgs, "-o", exeName, "main.go")
+	} else {
+		buildArgs = append(buildArgs, "main.go")
+	}
+	err = runIf(err, buildArgs)
+	if info.Vet {
+		vetArgs := []string{"go", "vet"}
+		if len(info.Files) > 0 {
+			vetArgs = append(vetArgs, ".")
+		} else {
+			vetArgs = append(vetArgs, "main.go")
+		}
+		err = runIf(err, vetArgs)
+	}
 	return err
 }
 
+// isolatedEnv returns env with the go folders inside dir
+// - the last value of a duplicate key wins
+// - -modcacherw makes the module cache removable
+func isolatedEnv(env []string, dir string) []string {
+	return append(append([]string(nil), env...),
+		"GOCACHE="+filepath.Join(dir, "cache"),
+		"GOMODCACHE="+filepath.Join(dir, "mod"),
+		"GOPATH="+filepath.Join(dir, "path"),
+		"GOFLAGS=-modcacherw")
+}
+
+// DirSources reads the .go files of dir, except tests, for a script split
+// over several files: goCode is main.go, or the only file, and files are
+// the others, e.g. for RunInfo.Files
+func DirSources(dir string) (goCode string, files map[string]string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	files = make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", nil, err
+		}
+		files[name] = string(buf)
+	}
+	mainFile := "main.go"
+	if len(files) == 1 {
+		for name := range files {
+			mainFile = name
+		}
+	}
+	goCode, found := files[mainFile]
+	if !found {
+		return "", nil, fmt.Errorf("no main.go among the .go files in %s", dir)
+	}
+	delete(files, mainFile)
+	return goCode, files, nil
+}
+
+// writeSources writes main.go and any extra files to dir
+func writeSources(dir string, info *RunInfo, goCode string) error {
+	gofile := filepath.Join(dir, "main.go")
+	err := os.WriteFile(gofile, []byte(goCode), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write %s - %w", gofile, err)
+	}
+	for name, content := range info.Files {
+		if name == "main.go" || filepath.Base(name) != name || !strings.HasSuffix(name, ".go") {
+			return fmt.Errorf("bad extra file name %q", name)
+		}
+		f := filepath.Join(dir, name)
+		err := os.WriteFile(f, []byte(content), 0666)
+		if err != nil {
+			return fmt.Errorf("failed to write %s - %w", f, err)
+		}
+	}
+	return nil
+}
+
 func CompileString(c *cache.Config, goCode string, args []string, input string) (string, error) {
+	return CompileStringInfo(c, &RunInfo{}, goCode, args, input)
+}
+
+// CompileStringNoCache is like CompileStringInfo but compiles into a new
+// temporary cache, so an executable from an earlier compile is never
+// used. The caller must call cleanup after the run to remove it, also
+// on error. An executable that replaces the process with Exec can not.
+func CompileStringNoCache(info *RunInfo, goCode string, args []string, input string) (outdir string, cleanup func(), err error) {
+	dir, err := os.MkdirTemp(info.TempDir, "gorun-no-cache")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	c, err := cache.NewConfig(dir, 0)
+	if err == nil {
+		outdir, err = CompileStringInfo(c, info, goCode, args, input)
+	}
+	return outdir, cleanup, err
+}
 
+// CompileStringInfo is like CompileString with extra settings in info
+func CompileStringInfo(c *cache.Config, info *RunInfo, goCode string, args []string, input string) (string, error) {
+	return CompileStringContext(context.Background(), c, info, goCode, args, input)
+}
+
+// cacheKeyEpoch is part of every cache key:
+// bump to invalidate all caches when gorun changes how executables are built
+const cacheKeyEpoch = 2
+
+// cacheInput returns the cache input for goCode and its embeds from
+// readEmbeds, with prefix first
+func cacheInput(info *RunInfo, goCode string, embeds map[string][]byte, prefix string, epoch int) (string, error) {
 	// must add everything that affects the computation:
 	// = input file, executables, env-vars, commandline
 	//
-
-	input += fmt.Sprintf("// gocompiler: %s\n", gocompiler.GoVersion())
-	input += fmt.Sprintf("// gorun: %s\n", GorunVersion())
-	input += fmt.Sprintf("// env.CGO_ENABLED: %s\n", os.Getenv("CGO_ENABLED"))
+	input := prefix
+	input += fmt.Sprintf("// epoch: %d\n", epoch)
+	if info.HashOnlySource {
+		input += "// hash-only-source\n"
+	} else {
+		input += fmt.Sprintf("// gocompiler: %s\n", gocompiler.GoVersion())
+		if info.Toolchain != "" && info.Toolchain != "embedded" {
+			tc, err := resolveToolchain(info.Toolchain)
+			if err != nil {
+				return "", err
+			}
+			input += fmt.Sprintf("// toolchain: %s %s\n", tc.path, tc.version)
+		}
+		input += fmt.Sprintf("// gorun: %s\n", GorunVersion())
+		input += fmt.Sprintf("// env.CGO_ENABLED: %s\n", os.Getenv("CGO_ENABLED"))
+		input += fmt.Sprintf("// env.GOFLAGS: %s\n", os.Getenv("GOFLAGS"))
+	}
+	if info.SourcePath != "" {
+		input += fmt.Sprintf("// source: %s\n", info.SourcePath)
+	}
+	if len(info.BuildFlags) > 0 {
+		input += fmt.Sprintf("// build: %q\n", info.BuildFlags)
+	}
+	if info.GOOS != "" || info.GOARCH != "" {
+		input += fmt.Sprintf("// target: %s/%s\n", info.GOOS, info.GOARCH)
+	}
+	if info.Debug {
+		input += "// debug: 1\n"
+	}
+	if info.Vet {
+		input += "// vet: 1\n"
+	}
+	if info.Race {
+		input += "// race: 1\n"
+	}
 	input += "//\n"
 	input += fmt.Sprintf("%s\n", goCode)
+	var names []string
+	for name := range info.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		input += fmt.Sprintf("// file: %s\n%s\n", name, info.Files[name])
+	}
+	names = names[:0]
+	for name := range embeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		input += fmt.Sprintf("// embed: %s %x\n", name, sha256.Sum256(embeds[name]))
+	}
+	return input, nil
+}
+
+// Compiling returns the process that compiles goCode with info and
+// input as given to CompileStringContext, and whether it is still busy
+func Compiling(c *cache.Config, info *RunInfo, goCode string, input string) (cache.Owner, bool, error) {
+	embeds, err := readEmbeds(info, goCode)
+	if err != nil {
+		return cache.Owner{}, false, err
+	}
+	input, err = cacheInput(info, goCode, embeds, input, cacheKeyEpoch)
+	if err != nil {
+		return cache.Owner{}, false, err
+	}
+	return c.Compiling(input)
+}
+
+// Purge deletes the cached executable of goCode with info and input as
+// given to CompileStringContext, so the next run compiles it again.
+// No error if it is not cached.
+func Purge(c *cache.Config, info *RunInfo, goCode string, input string) error {
+	embeds, err := readEmbeds(info, goCode)
+	if err != nil {
+		return err
+	}
+	input, err = cacheInput(info, goCode, embeds, input, cacheKeyEpoch)
+	if err != nil {
+		return err
+	}
+	return c.Purge(input)
+}
+
+// checkRace fails with a clear message if the C compiler that the race
+// detector needs through cgo is missing, instead of a cgo error in the build
+func checkRace(env []string) error {
+	cc := "gcc"
+	if runtime.GOOS == "darwin" || runtime.GOOS == "freebsd" || runtime.GOOS == "openbsd" {
+		cc = "clang"
+	}
+	for _, kv := range env {
+		if v, found := strings.CutPrefix(kv, "CC="); found && strings.TrimSpace(v) != "" {
+			cc = strings.Fields(v)[0] // last wins, as with exec
+		}
+	}
+	_, err := exec.LookPath(cc)
+	if err != nil {
+		return fmt.Errorf("the race detector needs cgo and a C compiler, %s not found - set CC or install one", cc)
+	}
+	return nil
+}
+
+// checkMinGo fails with a clear message if the toolchain is older than
+// gorun:min-go, instead of a compile error deep in the build
+func checkMinGo(info *RunInfo, d Directives) error {
+	if d.MinGo == "" {
+		return nil
+	}
+	tc, err := resolveToolchain(info.Toolchain)
+	if err != nil {
+		return err
+	}
+	if version.Compare(tc.version, "go"+d.MinGo) < 0 {
+		return fmt.Errorf("script requires go %s or later, the toolchain is %s", d.MinGo, tc.version)
+	}
+	return nil
+}
+
+// checkVet fails before a build if vet is asked for with the embedded
+// toolchain, as vet is not embedded
+func checkVet(info *RunInfo) error {
+	if info.Vet && (info.Toolchain == "" || info.Toolchain == "embedded") {
+		return fmt.Errorf("vet is not part of the embedded toolchain, use an external toolchain, e.g. -toolchain go1.22.0")
+	}
+	return nil
+}
+
+// CompileStringContext is like CompileStringInfo but stops a compile when
+// ctx is cancelled, e.g. on Ctrl-C. The partial build folder is then removed.
+func CompileStringContext(ctx context.Context, c *cache.Config, info *RunInfo, goCode string, args []string, input string) (string, error) {
+
+	// directives are part of goCode and thereby the cache key
+	d, err := ParseDirectives(goCode)
+	if err != nil {
+		return "", err
+	}
+	err = checkMinGo(info, d)
+	if err == nil {
+		err = checkVet(info)
+	}
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	embeds, err := readEmbeds(info, goCode)
+	if err != nil {
+		return "", err
+	}
+	input, err = cacheInput(info, goCode, embeds, input, cacheKeyEpoch)
+	if err != nil {
+		return "", err
+	}
+	info.Trace.Span("cache key", start)
 
 	incompleteOutdir := ""
 
 	createCalled := false
-	outdir, err := c.Lookup(input, func(outdir string) error {
+	var createErr error
+	lookupStart := time.Now()
+	lockWait := true
+	outdir, err := c.LookupWaitContext(ctx, input, func(outdir string) error {
+		info.Trace.Span("lock wait", lookupStart)
+		lockWait = false
+		defer info.Trace.Span("compile", time.Now())
 
 		create := func() error {
 
 			createCalled = true
 			gofile := filepath.Join(outdir, "main.go")
-			exefile := filepath.Join(outdir, "main")
+			exefile := filepath.Join(outdir, info.ExeName())
 
-			err := os.WriteFile(gofile, []byte(goCode), 0666)
+			err := writeSources(outdir, info, goCode)
+			if err == nil {
+				err = writeEmbeds(outdir, embeds)
+			}
 			if err != nil {
-				return fmt.Errorf("failed to write %s - %w", gofile, err)
+				return err
 			}
 
-			err = compile(c, gofile, exefile)
-
+			err = compile(ctx, c, info, d, gofile, exefile, false)
+			if err == nil && info.MaxBinarySize > 0 {
+				err = checkBinarySize(exefile, info.MaxBinarySize)
+			}
 			return err
 		}
 		err := create()
+		createErr = err
+		if ctx.Err() != nil || errors.Is(err, ErrBinaryTooLarge) {
+			// interrupted or too large => nothing to debug
+			os.RemoveAll(outdir)
+			return err
+		}
 		incompleteOutdir = outdir // outdir only here if error during compile
 		return err
-	})
+	}, info.Wait, info.Waiting)
+	if lockWait {
+		info.Trace.Span("lock wait", lookupStart)
+	}
+	info.Trace.Span("lookup", lookupStart)
+	if err != nil && (createErr == nil || !errors.Is(err, createErr)) {
+		err = &CacheError{err}
+	}
 
 	if outdir == "" {
 		outdir = incompleteOutdir
 	}
 
+	info.Compiled = createCalled
+
 	if err == nil && createCalled {
 		// create called = no cached item found
 		// => we are already on a slow path
 		// => check if cache trim should occur
+		c.AddStats(1, 0)     // NOTE: error ignored - stats are informational
 		c.TrimPeriodically() // NOTE: error ignored - should be visible on request
+		if info.Name != "" {
+			c.Link(info.Name, outdir) // NOTE: error ignored - only for humans
+		}
 	}
+	logCompile(start, createCalled, outdir, err)
 
 	return outdir, err
 
 }
+
+// checkBinarySize returns ErrBinaryTooLarge if exefile is larger than max bytes
+func checkBinarySize(exefile string, max int64) error {
+	fileinfo, err := os.Stat(exefile)
+	if err != nil {
+		return err
+	}
+	if fileinfo.Size() > max {
+		return fmt.Errorf("executable is %d bytes, more than the maximum of %d - %w", fileinfo.Size(), max, ErrBinaryTooLarge)
+	}
+	return nil
+}
+
+// ModGraph writes the module dependency graph of outdir, a build folder
+// from CompileStringInfo, to w as printed by go mod graph
+func ModGraph(w io.Writer, info *RunInfo, outdir string) error {
+	tc, err := resolveToolchain(info.Toolchain)
+	if err != nil {
+		return err
+	}
+	cmd, err := tc.command(os.Environ(), "go", "mod", "graph")
+	if err != nil {
+		return fmt.Errorf("failed to create exec.Cmd object - %w", err)
+	}
+	cmd.Dir = outdir
+	var outerr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = w, &outerr
+	err = cmd.Run()
+	if err != nil {
+		return &CompileError{Stderr: outerr.String(), Err: err, Dir: outdir, Cmdline: "go mod graph"}
+	}
+	return nil
+}
+
+// DryCompile prepares the build folder for goCode in a temporary folder
+// and writes the folder listing and go.mod to w, but does not run go build.
+// The temporary folder is removed afterwards.
+func DryCompile(w io.Writer, info *RunInfo, goCode string) error {
+	d, err := ParseDirectives(goCode)
+	if err != nil {
+		return err
+	}
+	err = checkMinGo(info, d)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "gorun-dry-compile")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	embeds, err := readEmbeds(info, goCode)
+	if err != nil {
+		return err
+	}
+	err = writeSources(dir, info, goCode)
+	if err == nil {
+		err = writeEmbeds(dir, embeds)
+	}
+	if err != nil {
+		return err
+	}
+	gofile := filepath.Join(dir, "main.go")
+	err = compile(context.Background(), nil, info, d, gofile, filepath.Join(dir, info.ExeName()), true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# build folder:\n")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(w, " %s\n", entry.Name())
+	}
+	flags := append(append([]string(nil), d.Flags...), info.BuildFlags...)
+	if len(flags) > 0 {
+		fmt.Fprintf(w, "# build flags: %s\n", strings.Join(flags, " "))
+	}
+	gomod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# go.mod:\n%s", gomod)
+	return nil
+}
+
+// RunScript compiles goCode and runs the resulting executable as a child
+// process connected to the stdin, stdout and stderr of the current process.
+// It returns the exit code of the child.
+func RunScript(c *cache.Config, goCode string, args []string) (int, error) {
+	return RunScriptInfo(c, &RunInfo{}, goCode, args)
+}
+
+// RunScriptInfo is like RunScript with settings in info
+func RunScriptInfo(c *cache.Config, info *RunInfo, goCode string, args []string) (int, error) {
+	outdir, err := CompileStringInfo(c, info, goCode, args, "")
+	if err != nil {
+		return -1, err
+	}
+	exefile := filepath.Join(outdir, info.ExeName())
+	d, _ := ParseDirectives(goCode) // already validated by compile
+	cmd := d.command(exefile, args)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	exit, err := exitCode(exefile, cmd.Run())
+	if err == nil && info.AfterRun != nil {
+		info.AfterRun(exit, time.Since(start))
+	}
+	return exit, err
+}
+
+// RunScriptCapture is like RunScript but captures stdout and stderr of the
+// child instead of using the stdio of the current process
+func RunScriptCapture(c *cache.Config, goCode string, args []string) (stdout, stderr string, exit int, err error) {
+	info := &RunInfo{}
+	outdir, err := CompileStringInfo(c, info, goCode, args, "")
+	if err != nil {
+		return "", "", -1, err
+	}
+	exefile := filepath.Join(outdir, info.ExeName())
+	d, _ := ParseDirectives(goCode) // already validated by compile
+	cmd := d.command(exefile, args)
+	var out, outerr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &outerr
+
+	exit, err = exitCode(exefile, cmd.Run())
+	return out.String(), outerr.String(), exit, err
+}
+
+// exitCode converts the error from running exefile to an exit code
+// - a program that runs but fails is not an error
+// - a program killed by a signal is 128+signal, see ExitStatus
+func exitCode(exefile string, err error) (int, error) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return ExitStatus(exitErr), nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to run %s - %w", exefile, err)
+	}
+	return 0, nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"testing"
+
+	"github.com/bir3/gorun/cache"
+)
+
+func TestCacheKeyEpoch(t *testing.T) {
+	goCode := "package main\n\nfunc main() {}\n"
+	key := func(epoch int) string {
+		input, err := cacheInput(&RunInfo{}, goCode, nil, "", epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache.SHA256Hasher.Sum(input)
+	}
+	if key(cacheKeyEpoch) != key(cacheKeyEpoch) {
+		t.Fatal("cache key is not stable")
+	}
+	if key(cacheKeyEpoch) == key(cacheKeyEpoch+1) {
+		t.Fatal("bumping cacheKeyEpoch must change the cache key")
+	}
+}
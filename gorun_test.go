@@ -0,0 +1,899 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bir3/gocompiler"
+	"github.com/bir3/gorun"
+	"github.com/bir3/gorun/cache"
+)
+
+func TestMain(m *testing.M) {
+	// the go toolchain is built into the test executable and must be given a chance to run
+	if gocompiler.IsRunToolchainRequest() {
+		gocompiler.RunToolchain()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func testConfig(t *testing.T) *cache.Config {
+	config, err := cache.NewConfig(tempDir(t), 10*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestCompileOutput(t *testing.T) {
+	t.Parallel()
+	goCompileError := `package main
+
+import "fmt"
+
+func main() {
+}
+`
+	var stderrLines []string
+	info := &gorun.RunInfo{}
+	info.CompileOutput = func(line string, isStderr bool) {
+		if isStderr {
+			stderrLines = append(stderrLines, line)
+		}
+	}
+	_, err := gorun.CompileStringInfo(testConfig(t), info, goCompileError, nil, "")
+	var compileError *gorun.CompileError
+	if !errors.As(err, &compileError) {
+		t.Fatalf("expected CompileError, got %v", err)
+	}
+	if !strings.Contains(compileError.Stderr, `"fmt" imported and not used`) || compileError.Stdout != "" {
+		t.Fatalf("expected the compiler diagnostics in Stderr only, got stdout %q stderr %q", compileError.Stdout, compileError.Stderr)
+	}
+	if !strings.HasPrefix(compileError.Cmdline, "go build") || compileError.Dir == "" {
+		t.Fatalf("expected go build command and folder, got %q in %q", compileError.Cmdline, compileError.Dir)
+	}
+	// streamed output covers all steps, buffered output only the failed step
+	streamed := strings.Join(stderrLines, "\n")
+	if !strings.HasSuffix(streamed, strings.TrimSuffix(compileError.Stderr, "\n")) {
+		t.Fatalf("streamed output %q differs from buffered %q", streamed, compileError.Stderr)
+	}
+	if !strings.Contains(streamed, `"fmt" imported and not used`) {
+		t.Fatalf("missing compile error in %q", streamed)
+	}
+}
+
+func TestToolchainEmbedded(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+
+	outdir1, err := gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: "embedded"}, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// explicit embedded toolchain is the default
+	outdir2, err := gorun.CompileString(config, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outdir1 != outdir2 {
+		t.Fatalf("expected same cache entry, got %s and %s", outdir1, outdir2)
+	}
+
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: "go0.0-missing"}, goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected toolchain not found, got %v", err)
+	}
+}
+
+func TestRunScriptCapture(t *testing.T) {
+	t.Parallel()
+	goCode := `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Printf("out %s\n", os.Args[1])
+	fmt.Fprintf(os.Stderr, "err %s\n", os.Args[2])
+	os.Exit(5)
+}
+`
+	stdout, stderr, exit, err := gorun.RunScriptCapture(testConfig(t), goCode, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "out a\n" || stderr != "err b\n" || exit != 5 {
+		t.Fatalf("got stdout=%q stderr=%q exit=%d", stdout, stderr, exit)
+	}
+}
+
+func TestRunScriptSignal(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("no signals on windows")
+	}
+	goCode := `package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func main() {
+	syscall.Kill(os.Getpid(), syscall.SIGKILL)
+}
+`
+	_, _, exit, err := gorun.RunScriptCapture(testConfig(t), goCode, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != 128+9 {
+		t.Fatalf("expected exit code 137 for SIGKILL, got %d", exit)
+	}
+}
+
+func TestRace(t *testing.T) {
+	// not parallel: uses t.Setenv
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+	_, err := gorun.CompileString(config, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not the cached non-race executable
+	t.Setenv("CC", "no-such-cc")
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{Race: true}, goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "the race detector needs cgo and a C compiler, no-such-cc not found") {
+		t.Fatalf("expected C compiler error, got %v", err)
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	// not parallel: uses t.Setenv
+	goCode := `// a normal comment
+// gorun:flags -ldflags "-X main.v=from-flags"
+// gorun:args first
+// gorun:env GORUN_TEST_A=a GORUN_TEST_PATH=ignored
+package main
+
+// gorun:bad after package clause is ignored
+
+import (
+	"fmt"
+	"os"
+)
+
+var v = "unset"
+
+func main() {
+	fmt.Println(v, os.Args[1:], os.Getenv("GORUN_TEST_A"), os.Getenv("GORUN_TEST_PATH") != "ignored")
+}
+`
+	d, err := gorun.ParseDirectives(goCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Flags) != 2 || d.Flags[1] != "-X main.v=from-flags" {
+		t.Fatalf("bad flags %q", d.Flags)
+	}
+
+	t.Setenv("GORUN_TEST_PATH", "set by user")
+	stdout, stderr, exit, err := gorun.RunScriptCapture(testConfig(t), goCode, []string{"second"})
+	if err != nil || exit != 0 {
+		t.Fatalf("exit %d %v\n%s", exit, err, stderr)
+	}
+	expect := "from-flags [first second] a true\n"
+	if stdout != expect {
+		t.Fatalf("got %q but expected %q", stdout, expect)
+	}
+
+	// also without space after //, like //go: directives
+	d, err = gorun.ParseDirectives("//gorun:require example.com/m v1.2.3\npackage main\n")
+	if err != nil || len(d.Require) != 1 || d.Require[0] != "example.com/m@v1.2.3" {
+		t.Fatalf("bad require %q %v", d.Require, err)
+	}
+
+	_, err = gorun.ParseDirectives("// gorun:unknown x\npackage main\n")
+	if err == nil {
+		t.Fatal("expected error for unknown directive")
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		t.Helper()
+		f := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(f), 0777)
+		if err == nil {
+			err = os.WriteFile(f, []byte(content), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("data.txt", "data v1")
+	write("assets/templates/page.html", "<p>page</p>")
+	goCode := `// gorun:embed data.txt ./assets/...
+package main
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed data.txt
+var data string
+
+//go:embed assets
+var assets embed.FS
+
+func main() {
+	page, _ := assets.ReadFile("assets/templates/page.html")
+	fmt.Printf("%s %s\n", data, page)
+}
+`
+	run := func(expect string) bool {
+		t.Helper()
+		info := &gorun.RunInfo{ScriptDir: dir}
+		outdir, err := gorun.CompileStringInfo(config, info, goCode, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := exec.Command(filepath.Join(outdir, "main")).CombinedOutput()
+		if err != nil || string(buf) != expect {
+			t.Fatalf("expected %q, got %v\n%s", expect, err, buf)
+		}
+		return info.Compiled
+	}
+	if !run("data v1 <p>page</p>\n") {
+		t.Fatal("expected compile")
+	}
+	if run("data v1 <p>page</p>\n") {
+		t.Fatal("expected cache hit")
+	}
+	write("data.txt", "data v2")
+	write("helper.go", "package main\n")
+	if !run("data v2 <p>page</p>\n") {
+		t.Fatal("expected compile after an embedded file changed")
+	}
+
+	for embed, expect := range map[string]string{
+		"../secret.txt": "outside the folder of the script",
+		"missing.txt":   "no such file",
+		"*.go":          "would be part of the build",
+	} {
+		_, err := gorun.CompileStringInfo(config, &gorun.RunInfo{ScriptDir: dir}, "// gorun:embed "+embed+"\npackage main\n\nfunc main() {}\n", nil, "")
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: expected error %q, got %v", embed, expect, err)
+		}
+	}
+	_, err := gorun.CompileStringInfo(config, &gorun.RunInfo{}, goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "needs the folder of the script") {
+		t.Fatalf("expected error without ScriptDir, got %v", err)
+	}
+}
+
+func TestMinGo(t *testing.T) {
+	t.Parallel()
+	goCode := "// gorun:min-go 1.999\npackage main\n\nfunc main() {}\n"
+	_, err := gorun.CompileString(testConfig(t), goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "script requires go 1.999 or later") {
+		t.Fatalf("expected min-go error, got %v", err)
+	}
+
+	goCode = "// gorun:min-go go1.21\npackage main\n\nfunc main() {}\n"
+	_, err = gorun.CompileString(testConfig(t), goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gorun.ParseDirectives("// gorun:min-go latest\npackage main\n")
+	if err == nil {
+		t.Fatal("expected error for bad go version")
+	}
+
+	// gorun:go is also the go line of go.mod
+	goCode = "//gorun:go 1.999\npackage main\n\nfunc main() {}\n"
+	_, err = gorun.CompileString(testConfig(t), goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "script requires go 1.999 or later") {
+		t.Fatalf("expected go directive error, got %v", err)
+	}
+	var out strings.Builder
+	err = gorun.DryCompile(&out, &gorun.RunInfo{}, "//gorun:go 1.21\npackage main\n\nfunc main() {}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\ngo 1.21\n") {
+		t.Fatalf("expected go 1.21 in go.mod, got:\n%s", out.String())
+	}
+}
+
+func TestBuildDirective(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	script := func(flags string) string {
+		return "//gorun:build " + flags + "\npackage main\n\nvar v = \"unset\"\n\nfunc main() { println(v) }\n"
+	}
+	_, stderr, exit, err := gorun.RunScriptCapture(config, script(`-ldflags "-s -w -X main.v=built"`), nil)
+	if err != nil || exit != 0 || stderr != "built\n" {
+		t.Fatalf("exit %d %v\n%s", exit, err, stderr)
+	}
+	a, err := gorun.CompileString(config, script(`-ldflags "-X main.v=a"`), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := gorun.CompileString(config, script(`-ldflags "-X main.v=b"`), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(a) == filepath.Dir(b) {
+		t.Fatalf("expected distinct cache entries for distinct flags, got %s", filepath.Dir(a))
+	}
+
+	_, err = gorun.CompileString(config, script("-no-such-flag"), nil, "")
+	var compileErr *gorun.CompileError
+	if !errors.As(err, &compileErr) || !strings.Contains(compileErr.Stderr, "no-such-flag") {
+		t.Fatalf("expected CompileError with toolchain stderr, got %v", err)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	t.Parallel()
+	goCode := "package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"same\") }\n"
+	var sums [][]byte
+	for i := 0; i < 2; i++ {
+		// other cache folder => other random build folder
+		outdir, err := gorun.CompileString(testConfig(t), goCode, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(filepath.Join(outdir, "main"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte(outdir)) {
+			t.Fatalf("build folder %s in the executable", outdir)
+		}
+		sum := sha256.Sum256(buf)
+		sums = append(sums, sum[:])
+	}
+	if !bytes.Equal(sums[0], sums[1]) {
+		t.Fatalf("expected identical executables, got sha256 %x and %x", sums[0], sums[1])
+	}
+}
+
+func TestCompileStringNoCache(t *testing.T) {
+	t.Parallel()
+	goCode := "package main\n\nfunc main() {}\n"
+	info := &gorun.RunInfo{TempDir: t.TempDir()}
+	var outdirs []string
+	for i := 0; i < 2; i++ {
+		outdir, cleanup, err := gorun.CompileStringNoCache(info, goCode, nil, "")
+		defer cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Compiled {
+			t.Fatal("expected a compile on every call")
+		}
+		outdirs = append(outdirs, outdir)
+	}
+	if outdirs[0] == outdirs[1] {
+		t.Fatalf("expected a new folder for each compile, got %s twice", outdirs[0])
+	}
+	_, cleanup, err := gorun.CompileStringNoCache(info, "package main\n\nfunc main() { x }\n", nil, "")
+	cleanup()
+	if err == nil {
+		t.Fatal("expected compile error")
+	}
+	for _, outdir := range outdirs {
+		if _, err := os.Stat(filepath.Join(outdir, "main")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(info.TempDir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected the folder of the failed compile removed, got %d entries %v", len(entries), err)
+	}
+}
+
+func TestIsolated(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	record := filepath.Join(dir, "gocache.txt")
+
+	// stub toolchain that records GOCACHE for each go command
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\necho \"$GOCACHE\" >> " + record + "\n"
+	err := os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &gorun.RunInfo{Toolchain: stubGo, Isolated: true}
+	_, err = gorun.CompileStringInfo(testConfig(t), info, "package main\n\nfunc main() {}\n", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(buf))
+	if len(lines) == 0 {
+		t.Fatal("toolchain was not called")
+	}
+	gocache := lines[0]
+	if !strings.Contains(gocache, "gorun-isolated") || gocache == os.Getenv("GOCACHE") {
+		t.Fatalf("expected isolated GOCACHE, got %q", gocache)
+	}
+	for _, line := range lines {
+		if line != gocache {
+			t.Fatalf("expected same GOCACHE for all go commands, got %q and %q", gocache, line)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(gocache)); !os.IsNotExist(err) {
+		t.Fatalf("isolated folder %s not removed", filepath.Dir(gocache))
+	}
+}
+
+func TestSourcePath(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+
+	compiled := func(sourcePath string) bool {
+		t.Helper()
+		info := &gorun.RunInfo{SourcePath: sourcePath}
+		_, err := gorun.CompileStringInfo(config, info, goCode, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Compiled
+	}
+	// path-independent by default
+	if !compiled("") || compiled("") {
+		t.Fatal("expected compile, then cache hit")
+	}
+	if !compiled("/scripts/a/tool.go") {
+		t.Fatal("expected own cache entry with a source path")
+	}
+	if compiled("/scripts/a/tool.go") {
+		t.Fatal("expected cache hit for the same source path")
+	}
+	if !compiled("/scripts/b/tool.go") {
+		t.Fatal("expected own cache entry for another source path")
+	}
+}
+
+func TestCompileLog(t *testing.T) {
+	// not parallel: uses t.Setenv
+	logfile := filepath.Join(t.TempDir(), "compile.log")
+	t.Setenv("GORUN_COMPILE_LOG", logfile)
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+	var outdirs []string
+	for i := 0; i < 2; i++ {
+		outdir, err := gorun.CompileString(config, goCode, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		outdirs = append(outdirs, outdir)
+	}
+	_, err := gorun.CompileString(config, "package main\n\nfunc main() { x }\n", nil, "")
+	if err == nil {
+		t.Fatal("expected compile error")
+	}
+
+	buf, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got\n%s", buf)
+	}
+	type logEntry struct {
+		Hit     bool
+		Seconds float64
+		Outdir  string
+		Error   string
+	}
+	var entries []logEntry
+	for _, line := range lines {
+		var entry logEntry
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("%s: %s", err, line)
+		}
+		entries = append(entries, entry)
+	}
+	if entries[0].Hit || !entries[1].Hit || entries[2].Hit {
+		t.Fatalf("expected miss, hit and miss, got\n%s", buf)
+	}
+	if entries[0].Outdir != outdirs[0] || entries[1].Outdir != outdirs[1] || entries[0].Seconds <= 0 {
+		t.Fatalf("bad outdir or time:\n%s", buf)
+	}
+	if !strings.Contains(entries[2].Error, "undefined: x") {
+		t.Fatalf("expected compile error in log, got\n%s", buf)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	record := filepath.Join(dir, "tmpdir.txt")
+
+	// stub toolchain that records TMPDIR for each go command
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\necho \"$TMPDIR\" >> " + record + "\n"
+	err := os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+	scratch := filepath.Join(dir, "scratch")
+	info := &gorun.RunInfo{Toolchain: stubGo, TempDir: scratch}
+	_, err = gorun.CompileStringInfo(config, info, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(buf))
+	if len(lines) == 0 {
+		t.Fatal("toolchain was not called")
+	}
+	for _, line := range lines {
+		if line != scratch {
+			t.Fatalf("expected TMPDIR %s, got %q", scratch, line)
+		}
+	}
+
+	// not part of the cache key
+	info = &gorun.RunInfo{Toolchain: stubGo, TempDir: filepath.Join(dir, "other")}
+	_, err = gorun.CompileStringInfo(config, info, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Compiled {
+		t.Fatal("expected cache hit with another TempDir")
+	}
+}
+
+func TestAfterRun(t *testing.T) {
+	t.Parallel()
+	goCode := `package main
+
+import (
+	"os"
+	"time"
+)
+
+func main() {
+	time.Sleep(10 * time.Millisecond)
+	os.Exit(3)
+}
+`
+	called := 0
+	info := &gorun.RunInfo{AfterRun: func(exitCode int, duration time.Duration) {
+		called++
+		if exitCode != 3 {
+			t.Errorf("expected exit code 3, got %d", exitCode)
+		}
+		if duration < 10*time.Millisecond {
+			t.Errorf("expected duration of at least 10ms, got %s", duration)
+		}
+	}}
+	exit, err := gorun.RunScriptInfo(testConfig(t), info, goCode, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != 3 || called != 1 {
+		t.Fatalf("expected exit 3 and one call, got exit %d and %d calls", exit, called)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	record := filepath.Join(dir, "args.txt")
+
+	// stub toolchain that records the arguments of each go command
+	stubGo := filepath.Join(dir, "go")
+	stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\necho \"$*\" >> " + record + "\n"
+	err := os.WriteFile(stubGo, []byte(stub), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+	optimized, err := gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: stubGo}, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(record)
+	debug, err := gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: stubGo, Debug: true}, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(optimized) == filepath.Dir(debug) {
+		t.Fatalf("expected distinct cache entries, got %s for both", filepath.Dir(debug))
+	}
+	buf, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "build -gcflags all=-N -l main.go") {
+		t.Fatalf("expected debug gcflags in go build, got:\n%s", buf)
+	}
+}
+
+func TestVet(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	goCode := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Printf(\"%d\\n\", \"x\")\n}\n"
+
+	_, err := gorun.CompileStringInfo(config, &gorun.RunInfo{Vet: true}, goCode, nil, "")
+	if err == nil || !strings.Contains(err.Error(), "vet is not part of the embedded toolchain") {
+		t.Fatalf("expected error for embedded toolchain, got %v", err)
+	}
+	entries, err := config.List()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected vet to fail before the build, got %v %v", entries, err)
+	}
+
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found in PATH")
+	}
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: goCmd}, goCode, nil, "")
+	if err != nil {
+		t.Fatalf("expected build without vet to succeed, got %v", err)
+	}
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{Toolchain: goCmd, Vet: true}, goCode, nil, "")
+	var compileErr *gorun.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected CompileError, got %v", err)
+	}
+	if !strings.Contains(compileErr.Stdout+compileErr.Stderr, "wrong type") {
+		t.Fatalf("expected vet report, got %s", err)
+	}
+}
+
+// writeModuleProxy writes a GOPROXY folder with module path@v1.0.0
+// for each name in modules, with the given go.mod requirements and source
+func writeModuleProxy(t *testing.T, dir string, modules map[string][2]string) {
+	for path, m := range modules {
+		gomod := fmt.Sprintf("module %s\n\ngo 1.21\n%s", path, m[0])
+		vdir := filepath.Join(dir, filepath.FromSlash(path), "@v")
+		err := os.MkdirAll(vdir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{
+			"list":        "v1.0.0\n",
+			"v1.0.0.info": `{"Version":"v1.0.0","Time":"2023-01-01T00:00:00Z"}`,
+			"v1.0.0.mod":  gomod,
+		}
+		for name, content := range files {
+			err := os.WriteFile(filepath.Join(vdir, name), []byte(content), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range map[string]string{"go.mod": gomod, "m.go": m[1]} {
+			w, err := zw.Create(path + "@v1.0.0/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(content))
+		}
+		err = zw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(vdir, "v1.0.0.zip"), buf.Bytes(), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestModGraph(t *testing.T) {
+	// not parallel: uses t.Setenv
+	proxy := t.TempDir()
+	writeModuleProxy(t, proxy, map[string][2]string{
+		"example.com/a": {"\nrequire example.com/b v1.0.0\n", "package a\n\nimport \"example.com/b\"\n\nfunc A() string { return b.B() }\n"},
+		"example.com/b": {"", "package b\n\nfunc B() string { return \"b\" }\n"},
+	})
+	t.Setenv("GOPROXY", "file://"+filepath.ToSlash(proxy))
+	t.Setenv("GOSUMDB", "off")
+	t.Setenv("GOFLAGS", "-modcacherw")
+	t.Setenv("GOMODCACHE", t.TempDir())
+
+	config := testConfig(t)
+	goCode := "// gorun:require example.com/a v1.0.0\npackage main\n\nimport \"example.com/a\"\n\nfunc main() { println(a.A()) }\n"
+	info := &gorun.RunInfo{}
+	outdir, err := gorun.CompileStringInfo(config, info, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graph bytes.Buffer
+	err = gorun.ModGraph(&graph, info, outdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, edge := range []string{"main example.com/a@v1.0.0\n", "example.com/a@v1.0.0 example.com/b@v1.0.0\n"} {
+		if !strings.Contains(graph.String(), edge) {
+			t.Fatalf("expected %q in graph:\n%s", edge, graph.String())
+		}
+	}
+}
+
+func TestConcurrentCompile(t *testing.T) {
+	t.Parallel()
+	config := testConfig(t)
+	compile := func(goCode string) (string, bool) {
+		info := &gorun.RunInfo{}
+		outdir, err := gorun.CompileStringInfo(config, info, goCode, nil, "")
+		if err != nil {
+			t.Error(err)
+		}
+		return outdir, info.Compiled
+	}
+
+	t1 := time.Now()
+	compile("package main\n\nfunc main() { println(1) }\n")
+	one := time.Since(t1)
+
+	// racers on the same uncached script wait for one compile
+	const n = 4
+	outdirs := make([]string, n)
+	compiled := make([]bool, n)
+	var wg sync.WaitGroup
+	t1 = time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outdirs[i], compiled[i] = compile("package main\n\nfunc main() { println(2) }\n")
+		}(i)
+	}
+	wg.Wait()
+	dt := time.Since(t1)
+
+	ncompiled := 0
+	for i := 0; i < n; i++ {
+		if compiled[i] {
+			ncompiled++
+		}
+		if outdirs[i] != outdirs[0] {
+			t.Fatalf("expected same outdir, got %s and %s", outdirs[0], outdirs[i])
+		}
+	}
+	if ncompiled != 1 {
+		t.Fatalf("expected one compile, got %d", ncompiled)
+	}
+	if dt > 2*one {
+		// serial compiles would take about n*one
+		t.Fatalf("%d racers took %s, one compile %s", n, dt, one)
+	}
+}
+
+func TestMaxBinarySize(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	config, err := cache.NewConfig(dir, 10*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goCode := "package main\n\nfunc main() {}\n"
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{MaxBinarySize: 1e9}, goCode, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goCode = "package main\n\nfunc main() { println() }\n"
+	_, err = gorun.CompileStringInfo(config, &gorun.RunInfo{MaxBinarySize: 1000}, goCode, nil, "")
+	if !errors.Is(err, gorun.ErrBinaryTooLarge) {
+		t.Fatalf("expected ErrBinaryTooLarge, got %v", err)
+	}
+	// only the objdir of the first compile is left
+	objdirs, err := filepath.Glob(filepath.Join(dir, "data", "*", "*", "*", "main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objdirs) != 1 {
+		t.Fatalf("expected oversized build to be removed, got %s", objdirs)
+	}
+}
+
+func TestStepTimeouts(t *testing.T) {
+	t.Parallel()
+	// stub toolchain where go <slow> hangs
+	stubGo := func(slow string) string {
+		stubGo := filepath.Join(t.TempDir(), "go")
+		stub := "#! /bin/sh\nif [ \"$1\" = env ]; then echo go1.22.0; exit 0; fi\nif [ \"$1\" = " + slow + " ]; then exec sleep 30; fi\n"
+		err := os.WriteFile(stubGo, []byte(stub), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stubGo
+	}
+	goCode := "package main\n\nfunc main() {}\n"
+	second := time.Second
+
+	tests := []struct {
+		slow   string
+		info   gorun.RunInfo
+		expect string
+	}{
+		{"get", gorun.RunInfo{GetTimeout: 200 * time.Millisecond, BuildTimeout: 30 * second}, "go get timed out"},
+		{"build", gorun.RunInfo{GetTimeout: 30 * second, BuildTimeout: 200 * time.Millisecond}, "go build timed out"},
+	}
+	for _, test := range tests {
+		info := test.info
+		info.Toolchain = stubGo(test.slow)
+		t1 := time.Now()
+		_, err := gorun.CompileStringInfo(testConfig(t), &info, goCode, nil, "")
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), test.expect) {
+			t.Fatalf("expected %q, got %v", test.expect, err)
+		}
+		if dt := time.Since(t1); dt > 10*second {
+			t.Fatalf("timeout took %s", dt)
+		}
+	}
+}
+
+func TestHashOnlySource(t *testing.T) {
+	// not parallel: uses t.Setenv
+	config := testConfig(t)
+	goCode := "package main\n\nfunc main() {}\n"
+	compiled := func(cgo string, hashOnlySource bool) bool {
+		t.Setenv("CGO_ENABLED", cgo)
+		info := &gorun.RunInfo{HashOnlySource: hashOnlySource}
+		_, err := gorun.CompileStringInfo(config, info, goCode, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Compiled
+	}
+	if !compiled("0", true) || compiled("1", true) {
+		t.Fatal("expected one compile when only CGO_ENABLED differs")
+	}
+	if !compiled("0", false) || !compiled("1", false) {
+		t.Fatal("expected CGO_ENABLED to be part of the normal key")
+	}
+}
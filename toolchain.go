@@ -0,0 +1,65 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bir3/gocompiler"
+)
+
+// toolchain is the go command used to compile
+// - empty path means the toolchain embedded by gocompiler
+type toolchain struct {
+	path    string
+	version string
+}
+
+// resolveToolchain finds the toolchain named by spec:
+//
+//	""  or "embedded" = embedded toolchain
+//	path to a go executable, e.g. /usr/local/go/bin/go
+//	version, e.g. go1.21.5 = executable of that name in PATH (golang.org/dl)
+func resolveToolchain(spec string) (toolchain, error) {
+	if spec == "" || spec == "embedded" {
+		return toolchain{"", gocompiler.GoVersion()}, nil
+	}
+	path := spec
+	if !strings.ContainsRune(spec, filepath.Separator) {
+		var err error
+		path, err = exec.LookPath(spec)
+		if err != nil {
+			return toolchain{}, fmt.Errorf("toolchain %s not found in PATH", spec)
+		}
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return toolchain{}, err
+	}
+	cmd := exec.Command(path, "env", "GOVERSION")
+	cmd.Env = append(os.Environ(), "GOTOOLCHAIN=local")
+	out, err := cmd.Output()
+	if err != nil {
+		return toolchain{}, fmt.Errorf("toolchain %s is not a working go command - %w", spec, err)
+	}
+	return toolchain{path, strings.TrimSpace(string(out))}, nil
+}
+
+// command returns a command for args, e.g. "go", "build"
+func (tc toolchain) command(env []string, args ...string) (*exec.Cmd, error) {
+	if tc.path == "" {
+		return gocompiler.Command(env, args...)
+	}
+	if len(args) < 2 || args[0] != "go" {
+		return nil, fmt.Errorf("toolchain %s can only run the go command", tc.path)
+	}
+	cmd := exec.Command(tc.path, args[1:]...)
+	cmd.Env = append(append([]string(nil), env...), "GOTOOLCHAIN=local")
+	return cmd, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Bergur Ragnarsson
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorun
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Trace records timed spans of gorun work in the Chrome Trace Event
+// format, e.g. for chrome://tracing or ui.perfetto.dev. Timestamps are
+// wall clock so the traces of several processes share a clock.
+// A nil *Trace records nothing. Safe for concurrent use.
+type Trace struct {
+	mu     sync.Mutex
+	events []traceEvent
+}
+
+type traceEvent struct {
+	Name string `json:"name"`
+	Ph   string `json:"ph"`  // X = complete event, i = instant event
+	Ts   int64  `json:"ts"`  // microseconds since the unix epoch
+	Dur  int64  `json:"dur"` // microseconds
+	Pid  int    `json:"pid"`
+	Tid  int    `json:"tid"`
+	S    string `json:"s,omitempty"` // scope of an instant event
+}
+
+// NewTrace returns an empty trace
+func NewTrace() *Trace {
+	return &Trace{}
+}
+
+func (t *Trace) add(e traceEvent) {
+	if t == nil {
+		return
+	}
+	e.Pid = os.Getpid()
+	e.Tid = 1
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+// Span records name from start until now
+func (t *Trace) Span(name string, start time.Time) {
+	t.add(traceEvent{Name: name, Ph: "X", Ts: start.UnixMicro(), Dur: time.Since(start).Microseconds()})
+}
+
+// Instant records name at the current time, e.g. exec of the program
+func (t *Trace) Instant(name string) {
+	t.add(traceEvent{Name: name, Ph: "i", Ts: time.Now().UnixMicro(), S: "p"})
+}
+
+// WriteFile writes the trace as JSON to filename
+func (t *Trace) WriteFile(filename string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := t.events
+	if events == nil {
+		events = []traceEvent{}
+	}
+	buf, err := json.MarshalIndent(map[string]any{"traceEvents": events, "displayTimeUnit": "ms"}, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(buf, '\n'), 0666)
+}